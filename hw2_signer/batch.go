@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Batch is a group of items made by a Batch stage. Stages between Batch and Unbatch
+// must turn a Batch into a Batch of the same length with results in the same order,
+// so Unbatch knows which source item every result comes from.
+type Batch []interface{}
+
+type batchConfig struct {
+	size int
+	wait time.Duration
+}
+
+// Batch adds a stage which groups items into batches of up to size items.
+// A batch which isn't full is sent when its first item has waited for wait, if it is set.
+func (g *Graph) Batch(name string, size int, wait time.Duration) *Graph {
+	if size < 1 {
+		g.fail(fmt.Errorf("batch %s: size must be positive, got %d", name, size))
+		return g
+	}
+	if wait < 0 {
+		g.fail(fmt.Errorf("batch %s: negative wait", name))
+		return g
+	}
+	return g.addBuiltin(&graphNode{name: name, batch: &batchConfig{size, wait}})
+}
+
+// Unbatch adds a stage which sends elements of every Batch as separate items,
+// other values are passed as they are
+func (g *Graph) Unbatch(name string) *Graph {
+	return g.addBuiltin(&graphNode{name: name, unbatch: true})
+}
+
+// runBatch collects items into batches. Latency of the stage is the time
+// the first item of a batch has waited for it to be sent.
+func (r *stageRun) runBatch() error {
+	work := make(chan interface{})
+	feeding := r.startFeeders(work, false, nil)
+
+	var pending []pendingItem
+	var timer *time.Timer
+	var timeout <-chan time.Time
+
+	flush := func() error {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+
+		env := &item{seq: noSeq}
+		batch := make(Batch, 0, len(pending))
+		now := time.Now()
+		for _, p := range pending {
+			batch = append(batch, p.env.value)
+			if p.env.seq != noSeq {
+				env.seqs = append(env.seqs, p.env.seq)
+			}
+			env.seqs = append(env.seqs, p.env.seqs...)
+			if p.env.trace != 0 {
+				env.traces = append(env.traces, p.env.trace)
+			}
+			env.traces = append(env.traces, p.env.traces...)
+			r.span(p.env, p.at, now, nil)
+		}
+		env.value = batch
+
+		r.st.processed(now.Sub(pending[0].at), true)
+		pending = nil
+		if r.sink() {
+			r.markDone(env)
+			return nil
+		}
+		return r.send(env)
+	}
+
+	var err error
+	for open := true; open && err == nil; {
+		select {
+		case val, ok := <-work:
+			if !ok {
+				open = false
+				err = flush()
+				continue
+			}
+			if len(pending) == 0 && r.batch.wait > 0 {
+				timer = time.NewTimer(r.batch.wait)
+				timeout = timer.C
+			}
+			pending = append(pending, pendingItem{val.(*item), time.Now()})
+			if len(pending) >= r.batch.size {
+				err = flush()
+			}
+		case <-timeout:
+			timer, timeout = nil, nil
+			err = flush()
+		case <-r.abort.done:
+			open = false
+		}
+	}
+	if err != nil {
+		r.abort.fire()
+	}
+
+	for _, out := range r.outs {
+		close(out)
+	}
+	feeding.Wait()
+	r.st.finish()
+
+	return err
+}
+
+// runUnbatch splits batches back into items
+func (r *stageRun) runUnbatch() error {
+	work := make(chan interface{})
+	feeding := r.startFeeders(work, false, nil)
+
+	var err error
+	for val := range work {
+		env := val.(*item)
+		if err != nil || r.abort.fired() {
+			continue
+		}
+
+		start := time.Now()
+		batch, ok := env.value.(Batch)
+		if !ok {
+			r.st.forwarded(1)
+			if r.sink() {
+				r.markDone(env)
+			} else {
+				err = r.send(env)
+			}
+			r.span(env, start, time.Now(), err)
+			continue
+		}
+
+		// Without the seqs of all elements results can't be traced back to the source
+		seqs, traces := env.seqs, env.traces
+		if len(seqs) != len(batch) {
+			seqs = nil
+		}
+		if len(traces) != len(batch) {
+			traces = nil
+		}
+		for i, value := range batch {
+			part := &item{seq: noSeq, value: value}
+			if seqs != nil {
+				part.seq = seqs[i]
+			}
+			if traces != nil {
+				part.trace = traces[i]
+			}
+			r.st.forwarded(1)
+			if r.sink() {
+				r.markDone(part)
+			} else {
+				err = r.send(part)
+			}
+			r.span(part, start, time.Now(), err)
+			if err != nil {
+				break
+			}
+		}
+		if err != nil {
+			r.abort.fire()
+		}
+	}
+
+	for _, out := range r.outs {
+		close(out)
+	}
+	feeding.Wait()
+	r.st.finish()
+
+	return err
+}
+
+// BatchSigner is a Signer which can sign many inputs in one call
+type BatchSigner interface {
+	Signer
+	SignBatch(data []string) []string
+}
+
+// signBatch signs all data with one call of a batch signer,
+// other signers are called for every input in parallel
+func signBatch(signer Signer, data []string) []string {
+	if bs, ok := signer.(BatchSigner); ok {
+		return bs.SignBatch(data)
+	}
+	return distributedSign(signer, data)
+}
+
+// MultiHashBatchFunc is MultiHash of a Batch for stages between Batch and Unbatch,
+// all rounds of all items go to the Multi signer at once
+func MultiHashBatchFunc(scheme *HashScheme) ItemFunc {
+	return func(val interface{}) (interface{}, error) {
+		batch := val.(Batch)
+
+		inputData := make([]string, 0, len(batch)*scheme.Rounds)
+		for _, data := range batch {
+			for th := 0; th < scheme.Rounds; th++ {
+				inputData = append(inputData, strconv.Itoa(th)+data.(string))
+			}
+		}
+
+		resultsData := signBatch(scheme.Multi, inputData)
+
+		results := make(Batch, len(batch))
+		for i := range batch {
+			results[i] = strings.Join(resultsData[i*scheme.Rounds:(i+1)*scheme.Rounds], "")
+		}
+		return results, nil
+	}
+}
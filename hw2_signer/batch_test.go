@@ -0,0 +1,118 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runBatches(t *testing.T, source job, size int, wait time.Duration, opts ...PipelineOption) ([]int, []int) {
+	mu := &sync.Mutex{}
+	var sizes, got []int
+
+	g := NewGraph().
+		Stage("source", source).
+		Batch("batch", size, wait).
+		Map("double", func(data interface{}) (interface{}, error) {
+			batch := data.(Batch)
+			mu.Lock()
+			sizes = append(sizes, len(batch))
+			mu.Unlock()
+
+			results := make(Batch, len(batch))
+			for i, val := range batch {
+				results[i] = val.(int) * 2
+			}
+			return results, nil
+		}, 2).
+		Unbatch("unbatch").
+		Stage("sink", func(in, out chan interface{}) {
+			for val := range in {
+				got = append(got, val.(int))
+			}
+		}).
+		Chain("source", "batch", "double", "unbatch", "sink")
+
+	if err := NewPipeline(opts...).Run(g); err != nil {
+		t.Fatal(err)
+	}
+	sort.Ints(sizes)
+	sort.Ints(got)
+	return sizes, got
+}
+
+func TestBatchBySize(t *testing.T) {
+	sizes, got := runBatches(t, countTo(10), 4, 0)
+
+	if len(sizes) != 3 || sizes[0] != 2 || sizes[1] != 4 || sizes[2] != 4 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+	if len(got) != 10 || got[0] != 0 || got[9] != 18 {
+		t.Errorf("unexpected results %v", got)
+	}
+}
+
+func TestBatchByTime(t *testing.T) {
+	sizes, got := runBatches(t, func(in, out chan interface{}) {
+		out <- 1
+		out <- 2
+		time.Sleep(100 * time.Millisecond)
+		out <- 3
+	}, 10, 20*time.Millisecond)
+
+	if len(sizes) != 2 || sizes[0] != 1 || sizes[1] != 2 {
+		t.Errorf("unexpected batches %v", sizes)
+	}
+	if len(got) != 3 {
+		t.Errorf("unexpected results %v", got)
+	}
+}
+
+func TestBatchKeepsIdentity(t *testing.T) {
+	path, cleanup := tempCheckpoint(t)
+	defer cleanup()
+
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runBatches(t, countTo(10), 3, 0, WithCheckpoint(c, 0))
+
+	if c.Processed() != 10 {
+		t.Errorf("expected every source item to be tracked through batches, got %d", c.Processed())
+	}
+}
+
+func TestMultiHashBatch(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	batch := Batch{"a", "b", "c"}
+	for _, multi := range []string{"sha256", "crc32"} {
+		scheme, err := NewHashScheme("crc32", "md5", multi, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := MultiHashBatchFunc(scheme)(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results := res.(Batch)
+		for i, data := range batch {
+			if expected := multiHash(scheme, data); results[i] != expected {
+				t.Errorf("%s, item %d: expected %v, got %v", multi, i, expected, results[i])
+			}
+		}
+	}
+}
+
+func TestBatchValidation(t *testing.T) {
+	if NewGraph().Batch("batch", 0, 0).Validate() == nil {
+		t.Error("expected an error for empty batches")
+	}
+	if NewGraph().Unbatch("unbatch").Validate() == nil {
+		t.Error("expected an error for a stage with no input")
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const defaultBufferSize = 100
+
+// OverflowPolicy tells what a stage does when its output buffer is full
+type OverflowPolicy int
+
+const (
+	// Block waits until downstream takes an item, this is the default
+	Block OverflowPolicy = iota
+	// DropOldest throws away the oldest buffered item to make room for the new one
+	DropOldest
+	// DropNewest throws away the item which doesn't fit
+	DropNewest
+	// FailOnOverflow stops the stage and fails the pipeline with ErrBufferOverflow
+	FailOnOverflow
+)
+
+var ErrBufferOverflow = errors.New("output buffer overflow")
+
+func (op OverflowPolicy) String() string {
+	switch op {
+	case Block:
+		return "block"
+	case DropOldest:
+		return "drop-oldest"
+	case DropNewest:
+		return "drop-newest"
+	case FailOnOverflow:
+		return "error"
+	}
+	return fmt.Sprintf("OverflowPolicy(%d)", int(op))
+}
+
+type bufferConfig struct {
+	size   int
+	policy OverflowPolicy
+}
+
+func (bc bufferConfig) validate() error {
+	if bc.size < 0 {
+		return fmt.Errorf("negative buffer size %d", bc.size)
+	}
+	if bc.policy < Block || bc.policy > FailOnOverflow {
+		return fmt.Errorf("unknown overflow policy %v", bc.policy)
+	}
+	if bc.size == 0 && bc.policy != Block {
+		return fmt.Errorf("%v policy needs a buffer", bc.policy)
+	}
+	return nil
+}
+
+// WithBuffer sets the output buffer size and overflow policy for all stages
+func WithBuffer(size int, policy OverflowPolicy) PipelineOption {
+	return func(p *Pipeline) {
+		p.buffer = bufferConfig{size, policy}
+	}
+}
+
+// WithStageBuffer sets the output buffer size and overflow policy for a stage with the given index
+func WithStageBuffer(stage, size int, policy OverflowPolicy) PipelineOption {
+	return func(p *Pipeline) {
+		if p.stageBuffers == nil {
+			p.stageBuffers = make(map[int]bufferConfig)
+		}
+		p.stageBuffers[stage] = bufferConfig{size, policy}
+	}
+}
+
+func (p *Pipeline) bufferFor(stage int) bufferConfig {
+	if bc, ok := p.stageBuffers[stage]; ok {
+		return bc
+	}
+	return p.buffer
+}
+
+// push puts val into out according to the policy,
+// it reports whether some item was thrown away to do so
+func push(out chan *item, val *item, policy OverflowPolicy) (bool, error) {
+	switch policy {
+	case DropNewest:
+		select {
+		case out <- val:
+			return false, nil
+		default:
+			return true, nil
+		}
+
+	case DropOldest:
+		dropped := false
+		for {
+			select {
+			case out <- val:
+				return dropped, nil
+			default:
+			}
+			// Downstream may take the item before us, then just try again
+			select {
+			case <-out:
+				dropped = true
+			default:
+			}
+		}
+
+	case FailOnOverflow:
+		select {
+		case out <- val:
+			return false, nil
+		default:
+			return false, ErrBufferOverflow
+		}
+	}
+
+	out <- val
+	return false, nil
+}
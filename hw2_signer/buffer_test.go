@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackpressure(t *testing.T) {
+	const (
+		items  = 30
+		buffer = 2
+		// one item is held by the consumer, one is in flight between the job and its buffer
+		// and one more is waiting to be handed to the consumer
+		inFlight = 3
+	)
+
+	var produced int32
+	ahead := 0
+
+	p := NewPipeline(WithStageBuffer(0, buffer, Block))
+	err := p.Execute(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < items; i++ {
+				out <- i
+				atomic.AddInt32(&produced, 1)
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			consumed := 0
+			for range in {
+				consumed++
+				time.Sleep(5 * time.Millisecond)
+				if diff := int(atomic.LoadInt32(&produced)) - consumed; diff > ahead {
+					ahead = diff
+				}
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ahead > buffer+inFlight {
+		t.Errorf("producer ran %d items ahead of a slow consumer, expected at most %d", ahead, buffer+inFlight)
+	}
+	if st := p.Snapshot()[0]; st.SendWait < 50*time.Millisecond || st.QueueCap != buffer || st.MaxQueueLen != buffer {
+		t.Errorf("producer should have been blocked on a full buffer: %+v", st)
+	}
+}
+
+// runOverflow fills a small buffer while the consumer waits for the producer to finish
+func runOverflow(policy OverflowPolicy) ([]int, StageSnapshot, error) {
+	var got []int
+
+	p := NewPipeline(WithBuffer(2, policy))
+	err := p.Execute(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < 10; i++ {
+				out <- i
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			for !p.Snapshot()[0].Done {
+				time.Sleep(time.Millisecond)
+			}
+			for val := range in {
+				got = append(got, val.(int))
+			}
+		}),
+	)
+	return got, p.Snapshot()[0], err
+}
+
+func TestDropNewest(t *testing.T) {
+	got, st, err := runOverflow(DropNewest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) == 0 || got[len(got)-1] == 9 {
+		t.Errorf("newest items should be dropped, got %v", got)
+	}
+	if int(st.Dropped)+len(got) != 10 {
+		t.Errorf("got %d items and dropped %d, expected 10 in total", len(got), st.Dropped)
+	}
+}
+
+func TestDropOldest(t *testing.T) {
+	got, st, err := runOverflow(DropOldest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) < 2 || got[len(got)-1] != 9 || got[len(got)-2] != 8 {
+		t.Errorf("oldest items should be dropped, got %v", got)
+	}
+	if int(st.Dropped)+len(got) != 10 {
+		t.Errorf("got %d items and dropped %d, expected 10 in total", len(got), st.Dropped)
+	}
+}
+
+func TestFailOnOverflow(t *testing.T) {
+	got, _, err := runOverflow(FailOnOverflow)
+
+	stageErr, ok := err.(*StageError)
+	if !ok || stageErr.Stage != 0 || !errors.Is(err, ErrBufferOverflow) {
+		t.Fatalf("expected overflow of stage 0, got %v", err)
+	}
+	if len(got) == 10 {
+		t.Errorf("consumer should not get all the items")
+	}
+}
+
+func TestBufferValidation(t *testing.T) {
+	err := NewPipeline(WithStageBuffer(1, 0, DropOldest)).Execute(
+		job(func(in, out chan interface{}) {}),
+		job(func(in, out chan interface{}) {}),
+	)
+	if stageErr, ok := err.(*StageError); !ok || stageErr.Stage != 1 {
+		t.Errorf("expected configuration error for stage 1, got %v", err)
+	}
+}
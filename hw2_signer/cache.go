@@ -0,0 +1,154 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memo remembers results of a slow string function.
+// Concurrent calls with the same argument wait for the first one
+// instead of calling the function again.
+// If limit is positive only that many least recently used results are kept.
+// Panics of the function are not remembered, the next call tries again.
+type Memo struct {
+	fn    func(string) string
+	limit int
+
+	mu       sync.Mutex
+	results  map[string]*list.Element
+	order    *list.List
+	inflight map[string]*memoCall
+	hits     uint64
+	misses   uint64
+}
+
+type memoEntry struct {
+	key    string
+	result string
+}
+
+type memoCall struct {
+	done   chan struct{}
+	result string
+	// panicked is true if fn panicked with panicValue, waiters panic with it too
+	panicked   bool
+	panicValue interface{}
+}
+
+func NewMemo(fn func(string) string, limit int) *Memo {
+	return &Memo{
+		fn:       fn,
+		limit:    limit,
+		results:  make(map[string]*list.Element),
+		order:    list.New(),
+		inflight: make(map[string]*memoCall),
+	}
+}
+
+func (m *Memo) Get(key string) string {
+	m.mu.Lock()
+
+	if el, ok := m.results[key]; ok {
+		m.hits++
+		m.order.MoveToFront(el)
+		m.mu.Unlock()
+		return el.Value.(*memoEntry).result
+	}
+
+	if c, ok := m.inflight[key]; ok {
+		m.hits++
+		m.mu.Unlock()
+		<-c.done
+		if c.panicked {
+			panic(c.panicValue)
+		}
+		return c.result
+	}
+
+	m.misses++
+	c := &memoCall{done: make(chan struct{}), panicked: true}
+	m.inflight[key] = c
+	m.mu.Unlock()
+
+	defer func() {
+		if c.panicked {
+			c.panicValue = recover()
+		}
+
+		m.mu.Lock()
+		delete(m.inflight, key)
+		if !c.panicked {
+			m.store(key, c.result)
+		}
+		m.mu.Unlock()
+
+		close(c.done)
+		if c.panicked {
+			panic(c.panicValue)
+		}
+	}()
+
+	c.result = m.fn(key)
+	c.panicked = false
+	return c.result
+}
+
+func (m *Memo) store(key, result string) {
+	m.results[key] = m.order.PushFront(&memoEntry{key, result})
+	if m.limit > 0 && m.order.Len() > m.limit {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.results, oldest.Value.(*memoEntry).key)
+	}
+}
+
+func (m *Memo) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.order.Len()
+}
+
+// Stats returns how many calls were served from the cache and how many called the function
+func (m *Memo) Stats() (hits, misses uint64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.hits, m.misses
+}
+
+// SignerCache memoizes DataSignerCrc32 and DataSignerMd5 for the signer stages
+type SignerCache struct {
+	Crc32 *Memo
+	Md5   *Memo
+}
+
+var signerCache *SignerCache
+
+// EnableSignerCache makes SingleHash and MultiHash reuse signer results,
+// limit bounds every cache, 0 means unbounded.
+// Results depend on DataSignerSalt, so enable it again after changing the salt.
+// It must not be called while a pipeline is running.
+func EnableSignerCache(limit int) *SignerCache {
+	signerCache = &SignerCache{
+		Crc32: NewMemo(func(data string) string { return DataSignerCrc32(data) }, limit),
+		Md5:   NewMemo(func(data string) string { return DataSignerMd5(data) }, limit),
+	}
+	return signerCache
+}
+
+func DisableSignerCache() {
+	signerCache = nil
+}
+
+func signCrc32(data string) string {
+	if c := signerCache; c != nil {
+		return c.Crc32.Get(data)
+	}
+	return DataSignerCrc32(data)
+}
+
+func signMd5(data string) string {
+	if c := signerCache; c != nil {
+		return c.Md5.Get(data)
+	}
+	return DataSignerMd5(data)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type signerCalls struct {
+	crc32 uint32
+	md5   uint32
+}
+
+// fastSigners replaces data signers with ones that don't sleep and count calls,
+// the returned function puts the original ones back
+func fastSigners() (*signerCalls, func()) {
+	calls := &signerCalls{}
+	origCrc32, origMd5 := DataSignerCrc32, DataSignerMd5
+
+	DataSignerCrc32 = func(data string) string {
+		atomic.AddUint32(&calls.crc32, 1)
+		return strconv.FormatUint(uint64(crc32.ChecksumIEEE([]byte(data+DataSignerSalt))), 10)
+	}
+	DataSignerMd5 = func(data string) string {
+		atomic.AddUint32(&calls.md5, 1)
+		return fmt.Sprintf("%x", md5.Sum([]byte(data+DataSignerSalt)))
+	}
+
+	return calls, func() {
+		DataSignerCrc32, DataSignerMd5 = origCrc32, origMd5
+	}
+}
+
+func signInts(input []int) string {
+	var result string
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for _, val := range input {
+				out <- val
+			}
+		}),
+		job(SingleHash),
+		job(MultiHash),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			result = (<-in).(string)
+		}),
+	)
+	return result
+}
+
+func TestMemoDeduplicatesCalls(t *testing.T) {
+	var calls uint32
+	m := NewMemo(func(data string) string {
+		atomic.AddUint32(&calls, 1)
+		time.Sleep(10 * time.Millisecond)
+		return data + "!"
+	}, 0)
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := m.Get("a"); res != "a!" {
+				t.Errorf("wrong result %q", res)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("expected a single call, got %d", calls)
+	}
+	if hits, misses := m.Stats(); hits != 9 || misses != 1 {
+		t.Errorf("expected 9 hits and 1 miss, got %d/%d", hits, misses)
+	}
+}
+
+func TestMemoPanic(t *testing.T) {
+	entered, release := make(chan struct{}), make(chan struct{})
+	fail := true
+	m := NewMemo(func(data string) string {
+		if fail {
+			close(entered)
+			<-release
+			panic("boom")
+		}
+		return data + "!"
+	}, 0)
+
+	get := func() (res string, r interface{}) {
+		defer func() { r = recover() }()
+		return m.Get("a"), nil
+	}
+
+	first := make(chan interface{})
+	go func() {
+		_, r := get()
+		first <- r
+	}()
+	<-entered
+
+	waiter := make(chan interface{})
+	go func() {
+		_, r := get()
+		waiter <- r
+	}()
+	// the waiter is counted as a hit before it waits
+	for hits, _ := m.Stats(); hits == 0; hits, _ = m.Stats() {
+		runtime.Gosched()
+	}
+	close(release)
+
+	for name, ch := range map[string]chan interface{}{"first call": first, "waiter": waiter} {
+		select {
+		case r := <-ch:
+			if r != "boom" {
+				t.Errorf("%s: expected the panic, got %v", name, r)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s: blocked after the panic", name)
+		}
+	}
+
+	fail = false
+	if res, r := get(); res != "a!" || r != nil {
+		t.Errorf("the panic should not be cached, got %q and %v", res, r)
+	}
+}
+
+func TestMemoEvictsLeastRecentlyUsed(t *testing.T) {
+	var calls uint32
+	m := NewMemo(func(data string) string {
+		atomic.AddUint32(&calls, 1)
+		return data
+	}, 2)
+
+	m.Get("a")
+	m.Get("b")
+	m.Get("a")
+	m.Get("c") // evicts b
+	m.Get("a")
+
+	if m.Len() != 2 || calls != 3 {
+		t.Fatalf("expected 2 cached results and 3 calls, got %d/%d", m.Len(), calls)
+	}
+	m.Get("b")
+	if calls != 4 {
+		t.Errorf("b should have been evicted")
+	}
+}
+
+func TestSignerCache(t *testing.T) {
+	calls, restore := fastSigners()
+	defer restore()
+
+	input := []int{0, 1, 1, 2, 3, 5, 8}
+	expected := signInts(input)
+	if calls.md5 != 7 || calls.crc32 != 7*8 {
+		t.Fatalf("unexpected number of calls without cache: %+v", calls)
+	}
+
+	cache := EnableSignerCache(0)
+	defer DisableSignerCache()
+	*calls = signerCalls{}
+
+	if result := signInts(input); result != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", result, expected)
+	}
+	// 1 comes twice
+	if calls.md5 != 6 || calls.crc32 != 6*8 {
+		t.Errorf("duplicates should be signed once: %+v", calls)
+	}
+
+	*calls = signerCalls{}
+	signInts(input)
+	if calls.md5 != 0 || calls.crc32 != 0 {
+		t.Errorf("second run should be served from cache: %+v", calls)
+	}
+	if hits, _ := cache.Crc32.Stats(); hits == 0 {
+		t.Errorf("no cache hits")
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Checkpoint remembers which source items have been fully processed, i.e. have arrived
+// at the sink, so a failed run can be resumed without processing them again.
+//
+// Source items are identified by their position, so the source must produce
+// the same items in the same order on every run.
+//
+// Delivery is at-least-once: an item is marked processed only after the sink is done with it,
+// so items processed since the last save are processed again after a restart.
+// A Map sink is done with an item when its function returns, a sink job when it takes
+// the next one or returns. A sink which combines items, like CombineResults, keeps nothing
+// in the checkpoint, so after a restart it combines only the items left.
+// Stages between the source and the sink must know which items their results come from:
+// Map, Batch and Unbatch stages and keyed jobs, like SingleHash, MultiHash and CombineResults.
+type Checkpoint struct {
+	path string
+
+	mu    sync.Mutex
+	next  uint64
+	done  map[uint64]bool
+	dirty bool
+}
+
+type checkpointFile struct {
+	// Every item before Next is processed
+	Next uint64   `json:"next"`
+	Done []uint64 `json:"done,omitempty"`
+}
+
+// LoadCheckpoint reads the checkpoint file, a missing file means a fresh start
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	c := &Checkpoint{path: path, done: make(map[uint64]bool)}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var f checkpointFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	c.next = f.Next
+	for _, seq := range f.Done {
+		c.done[seq] = true
+	}
+	return c, nil
+}
+
+// WithCheckpoint skips source items already processed according to c
+// and saves c every interval while the pipeline is running and once it is over
+func WithCheckpoint(c *Checkpoint, every time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.checkpoint = c
+		p.checkpointEvery = every
+	}
+}
+
+// Done tells whether the source item with this position is processed
+func (c *Checkpoint) Done(seq uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return seq < c.next || c.done[seq]
+}
+
+// Processed returns the number of processed items
+func (c *Checkpoint) Processed() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.next + uint64(len(c.done))
+}
+
+func (c *Checkpoint) markDone(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq < c.next || c.done[seq] {
+		return
+	}
+	c.done[seq] = true
+	for c.done[c.next] {
+		delete(c.done, c.next)
+		c.next++
+	}
+	c.dirty = true
+}
+
+// Save writes the checkpoint file if anything has changed,
+// after a failure the next Save tries again
+func (c *Checkpoint) Save() error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	f := checkpointFile{Next: c.next}
+	for seq := range c.done {
+		f.Done = append(f.Done, seq)
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	sort.Slice(f.Done, func(i, j int) bool { return f.Done[i] < f.Done[j] })
+	err := c.write(f)
+	if err != nil {
+		c.mu.Lock()
+		c.dirty = true
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *Checkpoint) write(f checkpointFile) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	// Write and rename, so a crash never leaves a broken file
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+func (p *Pipeline) startCheckpoint() func() error {
+	if p.checkpoint == nil {
+		return func() error { return nil }
+	}
+
+	stop := make(chan struct{})
+	done := make(chan error)
+
+	go func() {
+		var tick <-chan time.Time
+		if p.checkpointEvery > 0 {
+			ticker := time.NewTicker(p.checkpointEvery)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		var err error
+		for {
+			select {
+			case <-tick:
+				if saveErr := p.checkpoint.Save(); saveErr != nil && err == nil {
+					err = saveErr
+				}
+			case <-stop:
+				if saveErr := p.checkpoint.Save(); saveErr != nil && err == nil {
+					err = saveErr
+				}
+				done <- err
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		close(stop)
+		return <-done
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func tempCheckpoint(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "run.json"), func() { os.RemoveAll(dir) }
+}
+
+func countTo(n int) job {
+	return func(in, out chan interface{}) {
+		for i := 0; i < n; i++ {
+			out <- i
+		}
+	}
+}
+
+// collector is a sink which fails on the item failAt
+type collector struct {
+	mu     sync.Mutex
+	got    []int
+	failAt int
+}
+
+func (c *collector) take(data interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if data.(int) == c.failAt {
+		return nil, errors.New("disk is full")
+	}
+	c.got = append(c.got, data.(int))
+	return nil, nil
+}
+
+func runWithCheckpoint(t *testing.T, path string, sink *collector) error {
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGraph().
+		Stage("source", countTo(20)).
+		Map("double", func(data interface{}) (interface{}, error) {
+			return data, nil
+		}, 3).
+		Map("sink", sink.take, 1).
+		Chain("source", "double", "sink")
+	return NewPipeline(WithCheckpoint(c, time.Millisecond)).Run(g)
+}
+
+func TestCheckpointResume(t *testing.T) {
+	path, cleanup := tempCheckpoint(t)
+	defer cleanup()
+
+	first := &collector{failAt: 12}
+	if err := runWithCheckpoint(t, path, first); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+
+	second := &collector{failAt: -1}
+	if err := runWithCheckpoint(t, path, second); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	seen := make(map[int]bool)
+	for _, val := range first.got {
+		seen[val] = true
+	}
+	for _, val := range second.got {
+		if seen[val] {
+			t.Errorf("item %d is processed again after it was saved", val)
+		}
+		seen[val] = true
+	}
+	if len(seen) != 20 {
+		t.Errorf("expected every item to be processed, got %d", len(seen))
+	}
+	if len(second.got) == 20 {
+		t.Errorf("second run has started from scratch")
+	}
+
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Processed() != 20 {
+		t.Errorf("expected 20 processed items, got %d", c.Processed())
+	}
+}
+
+func TestCheckpointJobSink(t *testing.T) {
+	path, cleanup := tempCheckpoint(t)
+	defer cleanup()
+
+	// The sink combines items like CombineResults, the items it took before
+	// the failing one have arrived and are not taken again
+	var result []int
+	sink := func(failAt int) job {
+		return func(in, out chan interface{}) {
+			var got []int
+			for val := range in {
+				if val.(int) == failAt {
+					panic("disk is full")
+				}
+				got = append(got, val.(int))
+			}
+			result = got
+		}
+	}
+
+	for _, failAt := range []int{5, -1} {
+		c, err := LoadCheckpoint(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = NewPipeline(WithCheckpoint(c, 0)).Execute(countTo(10), sink(failAt))
+		if (err != nil) != (failAt >= 0) {
+			t.Fatalf("failAt %d: unexpected error %v", failAt, err)
+		}
+		if failAt >= 0 && c.Processed() != 5 {
+			t.Errorf("expected 5 items processed before the failure, got %d", c.Processed())
+		}
+	}
+
+	want := []int{5, 6, 7, 8, 9}
+	if !reflect.DeepEqual(result, want) {
+		t.Fatalf("expected %v, got %v", want, result)
+	}
+}
+
+func TestCheckpointSignerPipeline(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+	path, cleanup := tempCheckpoint(t)
+	defer cleanup()
+
+	// The source fails after some items have arrived at CombineResults
+	run := func(failAt int) ([]string, error) {
+		c, err := LoadCheckpoint(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var taken []string
+		err = NewPipeline(WithCheckpoint(c, time.Millisecond)).Execute(
+			func(in, out chan interface{}) {
+				for i := 0; i < 10; i++ {
+					if i == failAt {
+						for start := time.Now(); c.Processed() < 3; time.Sleep(time.Millisecond) {
+							if time.Since(start) > 5*time.Second {
+								t.Error("items don't arrive at the sink")
+								break
+							}
+						}
+						panic("source is down")
+					}
+					out <- i
+				}
+			},
+			SingleHash,
+			MultiHash,
+			func(in, out chan interface{}) {
+				taken = nil
+				results := make(chan interface{})
+				go CombineResults(results, make(chan interface{}, 1))
+				for val := range in {
+					taken = append(taken, val.(string))
+					results <- val
+				}
+				close(results)
+			},
+		)
+		return taken, err
+	}
+
+	first, err := run(6)
+	if err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := c.Processed()
+	if saved < 3 {
+		t.Fatalf("expected the items taken by the sink to be saved, got %d", saved)
+	}
+
+	second, err := run(-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every item is signed by one of the runs, the saved ones only by the first
+	seen := make(map[string]int)
+	for _, res := range first {
+		seen[res]++
+	}
+	for _, res := range second {
+		seen[res]++
+	}
+	for i := 0; i < 10; i++ {
+		if n := seen[signInts([]int{i})]; n == 0 {
+			t.Errorf("item %d is lost", i)
+		}
+	}
+	if uint64(len(second)) != 10-saved {
+		t.Errorf("%d items were saved, but the resumed run took %d of 10", saved, len(second))
+	}
+
+	c, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Processed() != 10 {
+		t.Errorf("expected 10 processed items, got %d", c.Processed())
+	}
+}
+
+func TestCheckpointFile(t *testing.T) {
+	path, cleanup := tempCheckpoint(t)
+	defer cleanup()
+
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []uint64{0, 1, 3, 5} {
+		c.markDone(seq)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"next":2,"done":[3,5]}` {
+		t.Errorf("unexpected file %s", data)
+	}
+
+	c, err = LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq, done := range []bool{true, true, false, true, false, true, false} {
+		if c.Done(uint64(seq)) != done {
+			t.Errorf("item %d: expected done %v", seq, done)
+		}
+	}
+}
+
+func TestCheckpointSaveRetry(t *testing.T) {
+	path, cleanup := tempCheckpoint(t)
+	defer cleanup()
+
+	// The directory of the file doesn't exist yet, so it can't be written
+	path = filepath.Join(filepath.Dir(path), "missing", "run.json")
+	c, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.markDone(0)
+	if err := c.Save(); err == nil {
+		t.Fatal("expected an error for a missing directory")
+	}
+
+	if err := os.Mkdir(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"next":1}` {
+		t.Errorf("progress of the failed save is lost: %s", data)
+	}
+}
+
+func TestCheckpointTopology(t *testing.T) {
+	c, _ := LoadCheckpoint(filepath.Join(os.TempDir(), "never-saved.json"))
+	g := NewGraph().
+		Stage("source", countTo(3)).
+		Stage("a", func(in, out chan interface{}) {
+			for range in {
+			}
+		}).
+		Stage("b", func(in, out chan interface{}) {
+			for range in {
+			}
+		}).
+		Chain("source", "a").
+		Chain("source", "b")
+
+	if err := NewPipeline(WithCheckpoint(c, 0)).Run(g); err == nil {
+		t.Error("expected an error for a graph with two sinks")
+	}
+
+	// A job which is not keyed may reorder items without telling
+	g = NewGraph().
+		Stage("source", countTo(3)).
+		Stage("shuffle", func(in, out chan interface{}) {
+			for val := range in {
+				out <- val
+			}
+		}).
+		Stage("sink", func(in, out chan interface{}) {
+			for range in {
+			}
+		}).
+		Chain("source", "shuffle", "sink")
+	err := NewPipeline(WithCheckpoint(c, 0)).Run(g)
+	if err == nil || !strings.Contains(err.Error(), "shuffle") {
+		t.Errorf("expected an error for a job stage in the middle, got %v", err)
+	}
+}
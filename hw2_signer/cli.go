@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const cliUsage = `Usage: signer [flags] [file...]
+       signer -serve network:address [-stage name] [flags]
+
+Signs every line of the files (or stdin if there are none or the file is "-")
+with SingleHash, MultiHash and CombineResults.
+
+With -serve it is a worker which runs a stage for pipelines with RemoteStage,
+e.g. signer -serve tcp:127.0.0.1:9000 -stage multi. It prints the address it
+listens on and serves until it is interrupted.
+
+Flags:
+`
+
+// cliLine is an input line on its way through the pipeline,
+// Result is what the stages have made of it so far
+type cliLine struct {
+	N      int    `json:"line"`
+	Input  string `json:"input"`
+	Result string `json:"result"`
+}
+
+type cliConfig struct {
+	single, multi, combine bool
+
+	scheme   *HashScheme
+	parallel int
+	json     bool
+	ordered  bool
+	trace    string
+}
+
+func main() {
+	os.Exit(runCLI(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func runCLI(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("signer", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprint(stderr, cliUsage)
+		flags.PrintDefaults()
+	}
+
+	stages := flags.String("stages", "single,multi,combine", "stages to run, any of single, multi and combine")
+	format := flags.String("format", "text", "output format: text or json")
+	order := flags.String("order", "input", "order of results: input or done (as soon as a line is signed)")
+	parallel := flags.Int("parallel", MaxInputDataLen, "number of lines signed at the same time by each stage")
+	salt := flags.String("salt", "", "salt added to data before signing")
+	outer := flags.String("outer", "crc32", "outer signer of SingleHash, see -signers")
+	inner := flags.String("inner", "md5", "inner signer of SingleHash")
+	multi := flags.String("multi", "crc32", "signer of MultiHash")
+	rounds := flags.Int("rounds", 6, "rounds of MultiHash")
+	list := flags.Bool("signers", false, "list available signers and exit")
+	trace := flags.String("trace", "", "write spans of every line to this file as JSON lines")
+	logLevel := flags.String("log", "", "log records of this level and above to stderr: debug, info, warn or error")
+	serve := flags.String("serve", "", "serve a stage to remote pipelines on network:address instead of signing files")
+	stage := flags.String("stage", "multi", "stage served with -serve: single, multi or combine")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *list {
+		fmt.Fprintln(stdout, strings.Join(Signers(), "\n"))
+		return 0
+	}
+
+	cfg, err := newCLIConfig(*stages, *format, *order, *parallel)
+	if err == nil {
+		cfg.scheme, err = NewHashScheme(*outer, *inner, *multi, *rounds)
+	}
+	if err == nil && *logLevel != "" {
+		var level Level
+		if level, err = parseLevel(*logLevel); err == nil {
+			SetLogger(NewTextLogger(stderr, level))
+			defer SetLogger(nil)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "signer:", err)
+		flags.Usage()
+		return 2
+	}
+
+	DataSignerSalt = *salt
+	cfg.trace = *trace
+
+	if *serve != "" {
+		j, err := workerJob(*stage, cfg.scheme)
+		if err != nil {
+			fmt.Fprintln(stderr, "signer:", err)
+			flags.Usage()
+			return 2
+		}
+		if err := runWorker(*serve, *stage, j, stderr); err != nil {
+			fmt.Fprintln(stderr, "signer:", err)
+			return 1
+		}
+		return 0
+	}
+
+	if err := runSigner(cfg, flags.Args(), stdin, stdout); err != nil {
+		fmt.Fprintln(stderr, "signer:", err)
+		return 1
+	}
+	return 0
+}
+
+func newCLIConfig(stages, format, order string, parallel int) (*cliConfig, error) {
+	cfg := &cliConfig{parallel: parallel}
+
+	for _, stage := range strings.Split(stages, ",") {
+		switch strings.TrimSpace(stage) {
+		case "single":
+			cfg.single = true
+		case "multi":
+			cfg.multi = true
+		case "combine":
+			cfg.combine = true
+		default:
+			return nil, fmt.Errorf("unknown stage %q", stage)
+		}
+	}
+
+	switch format {
+	case "text":
+	case "json":
+		cfg.json = true
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	switch order {
+	case "input":
+		cfg.ordered = true
+	case "done":
+	default:
+		return nil, fmt.Errorf("unknown order %q", order)
+	}
+
+	if parallel < 1 {
+		return nil, fmt.Errorf("parallel must be positive")
+	}
+	return cfg, nil
+}
+
+func parseLevel(s string) (Level, error) {
+	for level := LevelDebug; level <= LevelError; level++ {
+		if level.String() == s {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+// workerJob is the job of the stage served by a worker
+func workerJob(stage string, scheme *HashScheme) (job, error) {
+	switch stage {
+	case "single":
+		return NewSingleHash(scheme), nil
+	case "multi":
+		return NewMultiHash(scheme), nil
+	case "combine":
+		return CombineResults, nil
+	}
+	return nil, fmt.Errorf("unknown stage %q", stage)
+}
+
+// runWorker serves the job on the network:address spec until SIGINT or SIGTERM.
+// The address is printed to stderr, so a worker may listen on port 0.
+func runWorker(spec, stage string, j job, stderr io.Writer) error {
+	i := strings.Index(spec, ":")
+	if i < 0 {
+		return fmt.Errorf("serve address must be network:address, got %q", spec)
+	}
+	l, err := net.Listen(spec[:i], spec[i+1:])
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	stopped := make(chan struct{})
+	go func() {
+		<-signals
+		close(stopped)
+		l.Close()
+	}()
+
+	fmt.Fprintf(stderr, "signer: serving %s on %s:%s\n", stage, l.Addr().Network(), l.Addr())
+	err = ServeStage(l, j)
+	select {
+	case <-stopped:
+		return nil
+	default:
+		return err
+	}
+}
+
+func runSigner(cfg *cliConfig, files []string, stdin io.Reader, stdout io.Writer) error {
+	g := NewGraph().Stage("read", readLines(files, stdin))
+	last := "read"
+
+	if cfg.single {
+		g.Map("single", cliStage(cliSingleHash(cfg.scheme)), cfg.parallel).Connect(last, "single")
+		last = "single"
+	}
+	if cfg.multi {
+		g.Map("multi", cliStage(MultiHashFunc(cfg.scheme)), cfg.parallel).Connect(last, "multi")
+		last = "multi"
+	}
+	g.Stage("write", writeLines(cfg, stdout)).Connect(last, "write")
+
+	if cfg.trace == "" {
+		return NewPipeline().Run(g)
+	}
+
+	f, err := os.Create(cfg.trace)
+	if err != nil {
+		return err
+	}
+	tracer := NewJSONTracer(f)
+	err = NewPipeline(WithTracer(tracer)).Run(g)
+	if err == nil {
+		err = tracer.Err()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readLines is a source job of lines from files, failures to read panic and fail the pipeline
+func readLines(files []string, stdin io.Reader) job {
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	return func(in, out chan interface{}) {
+		n := 0
+		for _, name := range files {
+			if name == "-" {
+				scanLines(name, stdin, out, &n)
+				continue
+			}
+
+			f, err := os.Open(name)
+			if err != nil {
+				panic(err)
+			}
+			scanLines(name, f, out, &n)
+			f.Close()
+		}
+	}
+}
+
+func scanLines(name string, r io.Reader, out chan interface{}, n *int) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		*n++
+		out <- cliLine{N: *n, Input: scanner.Text(), Result: scanner.Text()}
+	}
+	if err := scanner.Err(); err != nil {
+		panic(fmt.Errorf("%s: %v", name, err))
+	}
+}
+
+// cliStage applies a hash function to the result of a line
+func cliStage(fn ItemFunc) ItemFunc {
+	return func(data interface{}) (interface{}, error) {
+		line := data.(cliLine)
+		res, err := fn(line.Result)
+		if err != nil {
+			return nil, err
+		}
+		line.Result = res.(string)
+		return line, nil
+	}
+}
+
+// cliSingleHash is SingleHashFunc of lines instead of numbers
+func cliSingleHash(scheme *HashScheme) ItemFunc {
+	quota := make(chan struct{}, 1)
+	return func(val interface{}) (interface{}, error) {
+		return singleHashData(scheme, val.(string), quota), nil
+	}
+}
+
+// writeLines prints results as they come, restores the input order
+// or combines them all into one line
+func writeLines(cfg *cliConfig, w io.Writer) job {
+	write := func(v interface{}, text string) {
+		var err error
+		if cfg.json {
+			err = json.NewEncoder(w).Encode(v)
+		} else {
+			_, err = fmt.Fprintln(w, text)
+		}
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return func(in, out chan interface{}) {
+		if cfg.combine {
+			var results []string
+			for val := range in {
+				results = append(results, val.(cliLine).Result)
+			}
+			result := combine(results)
+			write(map[string]string{"result": result}, result)
+			return
+		}
+
+		// Lines which are done before some of the lines preceding them
+		early := make(map[int]cliLine)
+		next := 1
+		for val := range in {
+			line := val.(cliLine)
+			if !cfg.ordered {
+				write(line, line.Result)
+				continue
+			}
+
+			early[line.N] = line
+			for {
+				line, ok := early[next]
+				if !ok {
+					break
+				}
+				delete(early, next)
+				next++
+				write(line, line.Result)
+			}
+		}
+	}
+}
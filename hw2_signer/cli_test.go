@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func runCLIWith(args []string, input string) (int, string, string) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	code := runCLI(args, strings.NewReader(input), stdout, stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCLI(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	code, stdout, stderr := runCLIWith(nil, "0\n1\n1\n2\n")
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	if expected := signInts([]int{0, 1, 1, 2}); stdout != expected+"\n" {
+		t.Errorf("expected %q, got %q", expected, stdout)
+	}
+}
+
+func TestCLIOrderedJSON(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	input := []string{"3", "1", "4", "1", "5", "9", "2", "6"}
+	code, stdout, stderr := runCLIWith(
+		[]string{"-stages", "single", "-format", "json", "-parallel", "4", "-salt", "pepper"},
+		strings.Join(input, "\n"),
+	)
+	DataSignerSalt = ""
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(stdout))
+	for i, data := range input {
+		var line cliLine
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("line %d: %v", i+1, err)
+		}
+		if line.N != i+1 || line.Input != data {
+			t.Errorf("line %d: results are out of order, got %+v", i+1, line)
+		}
+		if line.Result == data || !strings.Contains(line.Result, "~") {
+			t.Errorf("line %d: not a SingleHash result %q", i+1, line.Result)
+		}
+	}
+	if dec.More() {
+		t.Error("unexpected output after the last line")
+	}
+}
+
+func TestCLIErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-stages", "single,sort"},
+		{"-format", "xml"},
+		{"-order", "random"},
+		{"-parallel", "0"},
+		{"-inner", "rot13"},
+		{"-log", "verbose"},
+		{"-unknown"},
+		{"-serve", "tcp:127.0.0.1:0", "-stage", "sort"},
+	} {
+		if code, _, _ := runCLIWith(args, ""); code != 2 {
+			t.Errorf("%v: expected usage error, got exit code %d", args, code)
+		}
+	}
+
+	code, _, stderr := runCLIWith([]string{"no-such-file.txt"}, "")
+	if code != 1 || !strings.Contains(stderr, "no-such-file.txt") {
+		t.Errorf("expected a read error, got exit code %d: %s", code, stderr)
+	}
+
+	code, _, stderr = runCLIWith([]string{"-serve", "127.0.0.1"}, "")
+	if code != 1 || !strings.Contains(stderr, "network:address") {
+		t.Errorf("expected a serve address error, got exit code %d: %s", code, stderr)
+	}
+}
+
+// TestWorkerProcess is not a test, it is the signer worker started by TestCLIWorker,
+// its arguments follow "--"
+func TestWorkerProcess(t *testing.T) {
+	if os.Getenv("SIGNER_WORKER") != "1" {
+		return
+	}
+	fastSigners()
+
+	args := os.Args
+	for i, arg := range args {
+		if arg == "--" {
+			args = args[i+1:]
+			break
+		}
+	}
+	os.Exit(runCLI(args, os.Stdin, os.Stdout, os.Stderr))
+}
+
+func TestCLIWorker(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestWorkerProcess$", "--", "-serve", "tcp:127.0.0.1:0", "-stage", "multi")
+	cmd.Env = append(os.Environ(), "SIGNER_WORKER=1")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Process.Kill()
+
+	line, err := bufio.NewReader(stderr).ReadString('\n')
+	prefix := "signer: serving multi on tcp:"
+	if err != nil || !strings.HasPrefix(line, prefix) {
+		t.Fatalf("expected the worker address, got %q, %v", line, err)
+	}
+	addr := strings.TrimSpace(strings.TrimPrefix(line, prefix))
+
+	input := []int{0, 1, 1, 2, 3, 5, 8}
+	var result string
+	err = ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for _, val := range input {
+				out <- val
+			}
+		}),
+		job(SingleHash),
+		RemoteStage("tcp", addr),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			result = (<-in).(string)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != signInts(input) {
+		t.Errorf("worker result differs from local one:\n%s\n%s", result, signInts(input))
+	}
+
+	// the worker stops cleanly when it is told to
+	if err := cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Errorf("worker exit: %v", err)
+	}
+}
+
+func TestCLITrace(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	dir, err := ioutil.TempDir("", "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.json")
+
+	if code, _, stderr := runCLIWith([]string{"-trace", path}, "0\n1\n"); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	traces, err := ReadTraces(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 2 || len(traces[1]) < 3 {
+		t.Errorf("unexpected traces %v", traces)
+	}
+}
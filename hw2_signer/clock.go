@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the time source of data signers, OverheatLock and retry pauses,
+// tests replace SignerClock with a FakeClock so they don't have to wait
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+}
+
+var SignerClock Clock = realClock{}
+
+// The signers and overheat locks which sleep on SignerClock,
+// tests which replace the package variables can put them back
+var (
+	clockOverheatLock    = OverheatLock
+	clockOverheatUnlock  = OverheatUnlock
+	clockDataSignerMd5   = DataSignerMd5
+	clockDataSignerCrc32 = DataSignerCrc32
+)
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// FakeClock only moves when Advance is called
+type FakeClock struct {
+	mu       sync.Mutex
+	changed  *sync.Cond
+	now      time.Time
+	sleepers []*sleeper
+}
+
+type sleeper struct {
+	until time.Time
+	wake  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.changed = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := &sleeper{until: c.now.Add(d), wake: make(chan time.Time, 1)}
+	if d <= 0 {
+		s.wake <- c.now
+		return s.wake
+	}
+	c.sleepers = append(c.sleepers, s)
+	c.changed.Broadcast()
+	return s.wake
+}
+
+// Advance moves the clock forward and wakes up everyone whose time has come
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+	waiting := c.sleepers[:0]
+	for _, s := range c.sleepers {
+		if s.until.After(c.now) {
+			waiting = append(waiting, s)
+			continue
+		}
+		s.wake <- c.now
+	}
+	c.sleepers = waiting
+	c.changed.Broadcast()
+}
+
+// BlockUntil waits until exactly n goroutines are sleeping or waiting on After,
+// so the test knows everybody has got to the point it is going to advance the clock for
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.sleepers) != n {
+		c.changed.Wait()
+	}
+}
+
+// Sleepers returns the number of goroutines waiting for the clock
+func (c *FakeClock) Sleepers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.sleepers)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock installs a fake clock together with the signers and locks which use it,
+// since other tests replace them with ones which call time.Sleep
+func fakeClock() (*FakeClock, func()) {
+	orig := SignerClock
+	origLock, origUnlock := OverheatLock, OverheatUnlock
+	origMd5, origCrc32 := DataSignerMd5, DataSignerCrc32
+
+	c := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	SignerClock = c
+	OverheatLock, OverheatUnlock = clockOverheatLock, clockOverheatUnlock
+	DataSignerMd5, DataSignerCrc32 = clockDataSignerMd5, clockDataSignerCrc32
+
+	return c, func() {
+		SignerClock = orig
+		OverheatLock, OverheatUnlock = origLock, origUnlock
+		DataSignerMd5, DataSignerCrc32 = origMd5, origCrc32
+	}
+}
+
+// step waits for n sleeping goroutines and moves the clock forward. Goroutines start
+// to sleep in After before they block and only Advance wakes them, so between two steps
+// the number of sleepers only grows: once it is n, everybody the step waits for is asleep.
+func step(t *testing.T, c *FakeClock, n int, d time.Duration) {
+	t.Helper()
+	blocked := make(chan struct{})
+	go func() {
+		c.BlockUntil(n)
+		close(blocked)
+	}()
+	select {
+	case <-blocked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %d sleeping goroutines, got %d", n, c.Sleepers())
+	}
+	c.Advance(d)
+}
+
+func TestFakeClock(t *testing.T) {
+	c := NewFakeClock(time.Time{})
+	start := c.Now()
+
+	short, long := c.After(time.Second), c.After(time.Minute)
+	if now := <-c.After(0); !now.Equal(start) {
+		t.Errorf("After(0) should fire at once, got %v", now)
+	}
+
+	c.Advance(30 * time.Second)
+	select {
+	case now := <-short:
+		if now.Sub(start) != 30*time.Second {
+			t.Errorf("woke up at %v", now.Sub(start))
+		}
+	default:
+		t.Error("short timer should have fired")
+	}
+	select {
+	case <-long:
+		t.Error("long timer fired too early")
+	default:
+	}
+	if c.Sleepers() != 1 {
+		t.Errorf("expected 1 sleeper, got %d", c.Sleepers())
+	}
+}
+
+func TestSignerVirtualTime(t *testing.T) {
+	c, restore := fakeClock()
+	defer restore()
+
+	start := c.Now()
+	done := make(chan string)
+	go func() {
+		done <- signInts([]int{0, 1})
+	}()
+
+	// Both items start crc32(data), md5 calls go one by one
+	step(t, c, 3, 10*time.Millisecond)
+	// The first md5 is done and its item starts crc32(md5)
+	step(t, c, 4, 10*time.Millisecond)
+	// So does the second one
+	step(t, c, 4, 980*time.Millisecond)
+	// crc32(data) of both items is done
+	step(t, c, 2, 10*time.Millisecond)
+	// The first item goes to MultiHash with 6 crc32 calls at once
+	step(t, c, 7, 10*time.Millisecond)
+	// And the second one
+	step(t, c, 12, 990*time.Millisecond)
+	// MultiHash of the first item is done
+	step(t, c, 6, 10*time.Millisecond)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pipeline is not done")
+	}
+	if elapsed := c.Now().Sub(start); elapsed != 2020*time.Millisecond {
+		t.Errorf("expected the items to be signed in parallel in 2.02s, took %s", elapsed)
+	}
+}
+
+func TestOverheatVirtualTime(t *testing.T) {
+	c, restore := fakeClock()
+	defer restore()
+
+	start := c.Now()
+	done := make(chan struct{})
+	for i := 0; i < 2; i++ {
+		go func() {
+			DataSignerMd5("data")
+			done <- struct{}{}
+		}()
+	}
+
+	// One call signs, the other one has overheated the signer and waits for a second
+	step(t, c, 2, 10*time.Millisecond)
+	<-done
+	step(t, c, 1, 990*time.Millisecond)
+	step(t, c, 1, 10*time.Millisecond)
+	<-done
+
+	if elapsed := c.Now().Sub(start); elapsed != 1010*time.Millisecond {
+		t.Errorf("expected the overheat to cost a second, took %s", elapsed)
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Graph describes a pipeline where stages can have several inputs and outputs.
+// Every item sent by a stage goes to all of its downstream stages,
+// a stage with several upstream stages reads from all of them.
+// Stages with no upstream are sources, they get nil input channel,
+// results of stages with no downstream are thrown away.
+type Graph struct {
+	nodes  []*graphNode
+	byName map[string]int
+	err    error
+}
+
+type graphNode struct {
+	name    string
+	j       job
+	fn      ItemFunc
+	workers int
+	retry   *RetryPolicy
+	batch   *batchConfig
+	unbatch bool
+	from    []int
+	to      []int
+}
+
+func NewGraph() *Graph {
+	return &Graph{byName: make(map[string]int)}
+}
+
+// linearGraph connects jobs one after another, it is what ExecutePipeline runs
+func linearGraph(jobs []job) *Graph {
+	g := NewGraph()
+	for i, j := range jobs {
+		g.add(jobName(j), j)
+		if i > 0 {
+			g.connect(i-1, i)
+		}
+	}
+	return g
+}
+
+// Stage adds a named stage, names are used to connect stages
+// and show up in errors and metrics
+func (g *Graph) Stage(name string, j job) *Graph {
+	if _, ok := g.byName[name]; ok {
+		g.fail(fmt.Errorf("duplicate stage %q", name))
+		return g
+	}
+	if j == nil {
+		g.fail(fmt.Errorf("stage %q has no job", name))
+		return g
+	}
+	g.byName[name] = g.add(name, j)
+	return g
+}
+
+// Map adds a stage which calls fn for every item in up to workers goroutines.
+// Errors and panics of fn fail the pipeline or go to the dead letter sink.
+// Unlike jobs, the runtime knows which item every result comes from.
+func (g *Graph) Map(name string, fn ItemFunc, workers int) *Graph {
+	if fn == nil {
+		g.fail(fmt.Errorf("stage %q has no function", name))
+		return g
+	}
+	return g.addBuiltin(&graphNode{name: name, fn: fn, workers: workers})
+}
+
+// Connect sends results of one stage to another
+func (g *Graph) Connect(from, to string) *Graph {
+	fromIdx, ok := g.byName[from]
+	if !ok {
+		g.fail(fmt.Errorf("connect %s -> %s: unknown stage %q", from, to, from))
+		return g
+	}
+	toIdx, ok := g.byName[to]
+	if !ok {
+		g.fail(fmt.Errorf("connect %s -> %s: unknown stage %q", from, to, to))
+		return g
+	}
+	for _, next := range g.nodes[fromIdx].to {
+		if next == toIdx {
+			g.fail(fmt.Errorf("stages %s and %s are already connected", from, to))
+			return g
+		}
+	}
+	g.connect(fromIdx, toIdx)
+	return g
+}
+
+// Chain connects stages one after another
+func (g *Graph) Chain(names ...string) *Graph {
+	for i := 1; i < len(names); i++ {
+		g.Connect(names[i-1], names[i])
+	}
+	return g
+}
+
+// addBuiltin adds a stage run by the pipeline itself rather than by a job
+func (g *Graph) addBuiltin(node *graphNode) *Graph {
+	if _, ok := g.byName[node.name]; ok {
+		g.fail(fmt.Errorf("duplicate stage %q", node.name))
+		return g
+	}
+	g.byName[node.name] = len(g.nodes)
+	g.nodes = append(g.nodes, node)
+	return g
+}
+
+func (g *Graph) add(name string, j job) int {
+	g.nodes = append(g.nodes, &graphNode{name: name, j: j})
+	return len(g.nodes) - 1
+}
+
+func (g *Graph) connect(from, to int) {
+	g.nodes[from].to = append(g.nodes[from].to, to)
+	g.nodes[to].from = append(g.nodes[to].from, from)
+}
+
+func (g *Graph) fail(err error) {
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// checkpointable checks that source items can be tracked to the end of the pipeline.
+// Jobs which are not keyed don't tell which item a result comes from and may reorder
+// or combine items, so they can only be the source and the sink.
+func (g *Graph) checkpointable() error {
+	sources, sinks := 0, 0
+	for _, node := range g.nodes {
+		if len(node.from) == 0 {
+			sources++
+		}
+		if len(node.to) == 0 {
+			sinks++
+		}
+		if node.j != nil && !isKeyed(node.j) && len(node.from) > 0 && len(node.to) > 0 {
+			return fmt.Errorf("checkpoint can't track items through job stage %q, use a Map stage", node.name)
+		}
+	}
+	if sources != 1 || sinks != 1 {
+		return fmt.Errorf("checkpoint needs a single source and a single sink, got %d and %d", sources, sinks)
+	}
+	return nil
+}
+
+// Validate checks that the graph can be run:
+// all stages are connected and there are no cycles
+func (g *Graph) Validate() error {
+	if g.err != nil {
+		return g.err
+	}
+	if len(g.nodes) == 0 {
+		return fmt.Errorf("empty graph")
+	}
+
+	if len(g.nodes) > 1 {
+		for _, node := range g.nodes {
+			if len(node.from) == 0 && len(node.to) == 0 {
+				return fmt.Errorf("stage %q is not connected", node.name)
+			}
+		}
+	}
+	for _, node := range g.nodes {
+		if node.j == nil && len(node.from) == 0 {
+			return fmt.Errorf("stage %q has no input", node.name)
+		}
+	}
+
+	// Kahn's algorithm, whatever is left unsorted is on a cycle
+	inputs := make([]int, len(g.nodes))
+	var ready []int
+	for i, node := range g.nodes {
+		inputs[i] = len(node.from)
+		if inputs[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	sorted := 0
+	for len(ready) > 0 {
+		cur := ready[0]
+		ready = ready[1:]
+		sorted++
+		for _, next := range g.nodes[cur].to {
+			inputs[next]--
+			if inputs[next] == 0 {
+				ready = append(ready, next)
+			}
+		}
+	}
+
+	if sorted != len(g.nodes) {
+		// Walk back over unsorted stages, after len(nodes) steps we must be on the cycle
+		cur := 0
+		for inputs[cur] == 0 {
+			cur++
+		}
+		for step := 0; step < len(g.nodes); step++ {
+			for _, prev := range g.nodes[cur].from {
+				if inputs[prev] > 0 {
+					cur = prev
+					break
+				}
+			}
+		}
+		return fmt.Errorf("stage %q is on a cycle", g.nodes[cur].name)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGraphBroadcastAndJoin(t *testing.T) {
+	mu := &sync.Mutex{}
+	var got []string
+
+	g := NewGraph().
+		Stage("numbers", job(func(in, out chan interface{}) {
+			for i := 1; i <= 3; i++ {
+				out <- i
+			}
+		})).
+		Stage("double", job(func(in, out chan interface{}) {
+			for val := range in {
+				out <- strings.Repeat("x", val.(int)*2)
+			}
+		})).
+		Stage("triple", job(func(in, out chan interface{}) {
+			for val := range in {
+				out <- strings.Repeat("y", val.(int)*3)
+			}
+		})).
+		Stage("collect", job(func(in, out chan interface{}) {
+			for val := range in {
+				mu.Lock()
+				got = append(got, val.(string))
+				mu.Unlock()
+			}
+		})).
+		Connect("numbers", "double").
+		Connect("numbers", "triple").
+		Connect("double", "collect").
+		Connect("triple", "collect")
+
+	p := NewPipeline()
+	if err := p.Run(g); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(got)
+	expected := []string{"xx", "xxxx", "xxxxxx", "yyy", "yyyyyy", "yyyyyyyyy"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("got %v, expected %v", got, expected)
+	}
+
+	stages := p.Snapshot()
+	if stages[0].Out != 3 || stages[0].QueueCap != 200 || stages[3].In != 6 {
+		t.Errorf("unexpected metrics %+v", stages)
+	}
+}
+
+func TestGraphSigner(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	var result string
+	g := NewGraph().
+		Stage("input", job(func(in, out chan interface{}) {
+			out <- 0
+			out <- 1
+		})).
+		Stage("single", job(SingleHash)).
+		Stage("multi", job(MultiHash)).
+		Stage("combine", job(CombineResults)).
+		Stage("result", job(func(in, out chan interface{}) {
+			result = (<-in).(string)
+		})).
+		Chain("input", "single", "multi", "combine", "result")
+
+	if err := NewPipeline().Run(g); err != nil {
+		t.Fatal(err)
+	}
+	if result != signInts([]int{0, 1}) {
+		t.Errorf("graph and linear pipelines give different results")
+	}
+}
+
+func TestGraphValidation(t *testing.T) {
+	nop := job(func(in, out chan interface{}) {})
+
+	cases := map[string]struct {
+		graph *Graph
+		err   string
+	}{
+		"cycle": {
+			NewGraph().Stage("a", nop).Stage("b", nop).Stage("c", nop).Stage("d", nop).
+				Chain("a", "b", "c", "d").Connect("c", "b"),
+			`stage "b" is on a cycle`,
+		},
+		"self loop": {
+			NewGraph().Stage("a", nop).Stage("b", nop).Connect("a", "b").Connect("b", "b"),
+			`stage "b" is on a cycle`,
+		},
+		"not connected": {
+			NewGraph().Stage("a", nop).Stage("b", nop).Stage("c", nop).Connect("a", "b"),
+			`stage "c" is not connected`,
+		},
+		"unknown stage": {
+			NewGraph().Stage("a", nop).Connect("a", "b"),
+			`unknown stage "b"`,
+		},
+		"duplicate stage": {
+			NewGraph().Stage("a", nop).Stage("a", nop),
+			`duplicate stage "a"`,
+		},
+		"duplicate edge": {
+			NewGraph().Stage("a", nop).Stage("b", nop).Connect("a", "b").Connect("a", "b"),
+			"already connected",
+		},
+		"empty": {
+			NewGraph(),
+			"empty graph",
+		},
+	}
+
+	for name, c := range cases {
+		err := NewPipeline().Run(c.graph)
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: expected %q, got %v", name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("Level(%d)", int(l))
+}
+
+// Field is a key-value pair attached to a log record, like the stage name or the item index
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Logger receives log records of signers and pipelines, it is called from many goroutines
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Log(Level, string, ...Field) {}
+
+// loggerBox lets atomic.Value hold loggers of different types
+type loggerBox struct {
+	Logger
+}
+
+var packageLogger atomic.Value
+
+func init() {
+	packageLogger.Store(loggerBox{nopLogger{}})
+}
+
+// SetLogger sets the logger of signers and of pipelines without their own logger,
+// nothing is logged by default
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	packageLogger.Store(loggerBox{l})
+}
+
+func currentLogger() Logger {
+	return packageLogger.Load().(loggerBox).Logger
+}
+
+// WithLogger sets the logger of the pipeline
+func WithLogger(l Logger) PipelineOption {
+	return func(p *Pipeline) {
+		p.logger = l
+	}
+}
+
+// TextLogger writes records of at least its level as lines of text:
+// time, level, message and fields as key=value
+type TextLogger struct {
+	mu  sync.Mutex
+	w   io.Writer
+	min Level
+}
+
+func NewTextLogger(w io.Writer, min Level) *TextLogger {
+	return &TextLogger{w: w, min: min}
+}
+
+func (l *TextLogger) Log(level Level, msg string, fields ...Field) {
+	if level < l.min {
+		return
+	}
+
+	line := &strings.Builder{}
+	fmt.Fprintf(line, "%s %-5s %s", time.Now().Format("15:04:05.000"), level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(line, " %s=%v", f.Key, f.Value)
+	}
+	line.WriteByte('\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, line.String())
+}
+
+// itemFields describes an item processed by the stage
+func (r *stageRun) itemFields(env *item, d time.Duration) []Field {
+	fields := []Field{F("stage", r.st.name)}
+	if env.seq != noSeq {
+		fields = append(fields, F("item", env.seq))
+	}
+	return append(fields, F("duration", d))
+}
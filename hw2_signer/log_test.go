@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSilentByDefault(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	f, err := ioutil.TempFile("", "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	stdout := os.Stdout
+	os.Stdout = f
+	signInts([]int{0, 1})
+	os.Stdout = stdout
+	f.Close()
+
+	if out, _ := ioutil.ReadFile(f.Name()); len(out) > 0 {
+		t.Errorf("pipeline has written to stdout:\n%s", out)
+	}
+}
+
+func TestPipelineLogging(t *testing.T) {
+	buf := &syncBuffer{}
+	g := NewGraph().
+		Stage("source", countTo(3)).
+		Map("check", func(data interface{}) (interface{}, error) {
+			if data == 1 {
+				return nil, errors.New("bad item")
+			}
+			return data, nil
+		}, 1).
+		Chain("source", "check")
+
+	err := NewPipeline(
+		WithLogger(NewTextLogger(buf, LevelDebug)),
+		WithDeadLetter(func(DeadLetter) {}),
+	).Run(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := buf.String()
+	for _, line := range []string{
+		"debug item processed stage=check item=0 duration=",
+		"warn  item failed stage=check item=1 duration=",
+		"error=bad item",
+		"info  stage done stage=check in=3 out=2 duration=",
+	} {
+		if !strings.Contains(log, line) {
+			t.Errorf("no %q in log:\n%s", line, log)
+		}
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	buf := &syncBuffer{}
+	SetLogger(NewTextLogger(buf, LevelWarn))
+	signInts([]int{0})
+	SetLogger(NewTextLogger(buf, LevelDebug))
+	signInts([]int{1})
+	SetLogger(nil)
+
+	log := buf.String()
+	if strings.Count(log, "MultiHash got item stage=MultiHash data=") != 1 {
+		t.Errorf("debug records should be filtered:\n%s", log)
+	}
+}
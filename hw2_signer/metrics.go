@@ -0,0 +1,350 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var latencyBounds = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// Histogram counts durations into buckets, Counts[i] holds values below Bounds[i],
+// the last element of Counts holds everything above the last bound
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+	Max    time.Duration
+}
+
+func newHistogram(bounds []time.Duration) Histogram {
+	return Histogram{
+		Bounds: bounds,
+		Counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Bounds) && d >= h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+	if d > h.Max {
+		h.Max = d
+	}
+}
+
+func (h Histogram) Mean() time.Duration {
+	if h.Count == 0 {
+		return 0
+	}
+	return h.Sum / time.Duration(h.Count)
+}
+
+func (h Histogram) copy() Histogram {
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// StageSnapshot is a point-in-time view of a stage metrics
+//
+// Latency is measured from the moment the job takes an item
+// to the moment it emits the next result. Keyed jobs tell which inputs
+// produced an output, inputs of other jobs are matched with outputs in FIFO order,
+// for a job without input it is the time between two results.
+// For Map stages it is the time of the stage function call.
+type StageSnapshot struct {
+	Index int
+	Name  string
+
+	In  uint64
+	Out uint64
+
+	Latency Histogram
+
+	// Time spent waiting for an item from upstream
+	RecvWait time.Duration
+	// Time spent waiting for space in the output channel
+	SendWait time.Duration
+	// Items thrown away by the overflow policy
+	Dropped uint64
+	// Panics recovered from the job
+	Panics uint64
+	// Calls of a Map stage function repeated by the retry policy,
+	// Attempts[i] is the number of items which took i+1 calls
+	Retries  uint64
+	Attempts []uint64
+
+	// Summed over output channels of all downstream stages
+	QueueLen    int
+	QueueCap    int
+	MaxQueueLen int
+
+	Done bool
+}
+
+type stageStats struct {
+	index  int
+	name   string
+	queues []chan *item
+
+	mu       sync.Mutex
+	in, out  uint64
+	latency  Histogram
+	pending  []pendingItem
+	lastOut  time.Time
+	recvWait time.Duration
+	sendWait time.Duration
+	dropped  uint64
+	panics   uint64
+	attempts []uint64
+	last     *item
+	maxQueue int
+	done     bool
+}
+
+func newStageStats(index int, name string, queues []chan *item) *stageStats {
+	return &stageStats{
+		index:   index,
+		name:    name,
+		queues:  queues,
+		latency: newHistogram(latencyBounds),
+		lastOut: time.Now(),
+	}
+}
+
+func (s *stageStats) waited(d time.Duration) {
+	s.mu.Lock()
+	s.recvWait += d
+	s.mu.Unlock()
+}
+
+type pendingItem struct {
+	env *item
+	at  time.Time
+}
+
+// received counts an item taken by the stage, jobs also remember it
+// to match it with their output
+func (s *stageStats) received(env *item, track bool) {
+	s.mu.Lock()
+	s.in++
+	s.last = env
+	if track {
+		s.pending = append(s.pending, pendingItem{env, time.Now()})
+	}
+	s.mu.Unlock()
+}
+
+// emitted counts a job result and returns the input it is matched with, if any
+func (s *stageStats) emitted() (pendingItem, bool) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := s.lastOut
+	var from pendingItem
+	ok := len(s.pending) > 0
+	if ok {
+		from = s.pending[0]
+		since = from.at
+		s.pending = s.pending[1:]
+	}
+	s.latency.observe(now.Sub(since))
+	s.lastOut = now
+	s.out++
+	return from, ok
+}
+
+// emittedFrom counts a result of a keyed job and returns the inputs it is made from
+func (s *stageStats) emittedFrom(srcs []*item) []pendingItem {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var from []pendingItem
+	rest := s.pending[:0]
+	for _, p := range s.pending {
+		if containsItem(srcs, p.env) {
+			from = append(from, p)
+		} else {
+			rest = append(rest, p)
+		}
+	}
+	for i := len(rest); i < len(s.pending); i++ {
+		s.pending[i] = pendingItem{}
+	}
+	s.pending = rest
+
+	since := s.lastOut
+	if len(from) > 0 {
+		since = from[0].at
+	}
+	s.latency.observe(now.Sub(since))
+	s.lastOut = now
+	s.out++
+	return from
+}
+
+func containsItem(items []*item, env *item) bool {
+	for _, it := range items {
+		if it == env {
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes an input the job has failed on, it won't be matched with a result.
+// Keyed jobs tell the item, other inputs are found by value.
+func (s *stageStats) forget(value interface{}, env *item) (pendingItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range s.pending {
+		if p.env == env || env == nil && sameValue(p.env.value, value) {
+			s.pending = append(s.pending[:i:i], s.pending[i+1:]...)
+			return p, true
+		}
+	}
+	return pendingItem{}, false
+}
+
+// takePending returns the inputs which haven't been matched with results
+func (s *stageStats) takePending() []pendingItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+// processed counts an item handled by a Map stage
+func (s *stageStats) processed(d time.Duration, ok bool) {
+	s.mu.Lock()
+	s.latency.observe(d)
+	if ok {
+		s.out++
+	}
+	s.mu.Unlock()
+}
+
+// attempted counts calls of a Map stage function made for an item
+func (s *stageStats) attempted(n int) {
+	s.mu.Lock()
+	for len(s.attempts) < n {
+		s.attempts = append(s.attempts, 0)
+	}
+	s.attempts[n-1]++
+	s.mu.Unlock()
+}
+
+// forwarded counts items sent by an Unbatch stage
+func (s *stageStats) forwarded(n int) {
+	s.mu.Lock()
+	s.out += uint64(n)
+	s.mu.Unlock()
+}
+
+func (s *stageStats) sent(d time.Duration, queueLen int, dropped bool) {
+	s.mu.Lock()
+	s.sendWait += d
+	if dropped {
+		s.dropped++
+	}
+	if queueLen > s.maxQueue {
+		s.maxQueue = queueLen
+	}
+	s.mu.Unlock()
+}
+
+func (s *stageStats) lastItem() interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last == nil {
+		return nil
+	}
+	return s.last.value
+}
+
+func (s *stageStats) failed() {
+	s.mu.Lock()
+	s.panics++
+	s.mu.Unlock()
+}
+
+func (s *stageStats) finish() {
+	s.mu.Lock()
+	s.done = true
+	s.mu.Unlock()
+}
+
+func (s *stageStats) snapshot() StageSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var retries uint64
+	for i, n := range s.attempts {
+		retries += uint64(i) * n
+	}
+
+	queueLen, queueCap := 0, 0
+	for _, q := range s.queues {
+		queueLen += len(q)
+		queueCap += cap(q)
+	}
+
+	return StageSnapshot{
+		Index:       s.index,
+		Name:        s.name,
+		In:          s.in,
+		Out:         s.out,
+		Latency:     s.latency.copy(),
+		RecvWait:    s.recvWait,
+		SendWait:    s.sendWait,
+		Dropped:     s.dropped,
+		Panics:      s.panics,
+		Retries:     retries,
+		Attempts:    append([]uint64(nil), s.attempts...),
+		QueueLen:    queueLen,
+		QueueCap:    queueCap,
+		MaxQueueLen: s.maxQueue,
+		Done:        s.done,
+	}
+}
+
+// WriteReport prints stage metrics as a table
+func WriteReport(w io.Writer, stages []StageSnapshot) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tstage\tin\tout\tmean\tmax\trecv wait\tsend wait\tdropped\tpanics\tretries\tqueue\t")
+	for _, st := range stages {
+		name := st.Name
+		if st.Done {
+			name += " (done)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%d/%d\t\n",
+			st.Index, name, st.In, st.Out,
+			st.Latency.Mean().Round(time.Microsecond), st.Latency.Max.Round(time.Microsecond),
+			st.RecvWait.Round(time.Microsecond), st.SendWait.Round(time.Microsecond),
+			st.Dropped, st.Panics, st.Retries, st.QueueLen, st.QueueCap)
+	}
+	tw.Flush()
+}
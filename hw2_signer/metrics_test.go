@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPipelineMetrics(t *testing.T) {
+	report := &syncBuffer{}
+	p := NewPipeline(WithReport(report, 20*time.Millisecond))
+
+	p.Execute(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < 5; i++ {
+				out <- i
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				time.Sleep(20 * time.Millisecond)
+				out <- val
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			for range in {
+			}
+		}),
+	)
+
+	stages := p.Snapshot()
+	if len(stages) != 3 {
+		t.Fatalf("expected 3 stages, got %d", len(stages))
+	}
+
+	slow := stages[1]
+	if slow.In != 5 || slow.Out != 5 {
+		t.Errorf("slow stage: expected 5 in and 5 out, got %d/%d", slow.In, slow.Out)
+	}
+	if slow.Latency.Count != 5 || slow.Latency.Mean() < 20*time.Millisecond {
+		t.Errorf("slow stage: unexpected latency %d items, mean %s", slow.Latency.Count, slow.Latency.Mean())
+	}
+	if stages[0].Out != 5 || stages[2].In != 5 {
+		t.Errorf("items lost: source out %d, sink in %d", stages[0].Out, stages[2].In)
+	}
+	if stages[2].RecvWait < 50*time.Millisecond {
+		t.Errorf("sink should wait for the slow stage, waited %s", stages[2].RecvWait)
+	}
+	for _, st := range stages[:2] {
+		if !st.Done || st.QueueCap != 100 {
+			t.Errorf("stage %d: unexpected state %+v", st.Index, st)
+		}
+	}
+	if st := stages[2]; !st.Done || st.QueueCap != 0 {
+		t.Errorf("sink should have no output queue: %+v", st)
+	}
+
+	if !strings.Contains(report.String(), "TestPipelineMetrics.func2") {
+		t.Errorf("report has no stage names:\n%s", report.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.observe(time.Microsecond)
+	h.observe(10 * time.Millisecond)
+	h.observe(2 * time.Second)
+	h.observe(3 * time.Second)
+
+	if h.Counts[0] != 1 || h.Counts[1] != 1 || h.Counts[2] != 2 {
+		t.Errorf("wrong buckets %v", h.Counts)
+	}
+	if h.Max != 3*time.Second || h.Count != 4 {
+		t.Errorf("wrong max %s or count %d", h.Max, h.Count)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pipeline runs jobs connected by channels and keeps metrics for every stage
+type Pipeline struct {
+	reportTo    io.Writer
+	reportEvery time.Duration
+
+	buffer       bufferConfig
+	stageBuffers map[int]bufferConfig
+	deadLetter   func(DeadLetter)
+
+	checkpoint      *Checkpoint
+	checkpointEvery time.Duration
+
+	tracer Tracer
+	logger Logger
+
+	mu     sync.Mutex
+	stages []*stageStats
+}
+
+type PipelineOption func(p *Pipeline)
+
+// WithReport prints a text report of the pipeline metrics to w every interval
+// while the pipeline is running, and once more when it finishes
+func WithReport(w io.Writer, every time.Duration) PipelineOption {
+	return func(p *Pipeline) {
+		p.reportTo = w
+		p.reportEvery = every
+	}
+}
+
+func NewPipeline(opts ...PipelineOption) *Pipeline {
+	p := &Pipeline{
+		buffer: bufferConfig{defaultBufferSize, Block},
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// StageError tells which stage has failed the pipeline
+type StageError struct {
+	Stage int
+	Name  string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return fmt.Sprintf("stage %d (%s): %v", e.Stage, e.Name, e.Err)
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// Execute runs jobs one after another connected with channels
+// and returns the error of the first failed stage, if any
+func (p *Pipeline) Execute(jobs ...job) error {
+	return p.Run(linearGraph(jobs))
+}
+
+// Run validates the graph and runs all of its stages,
+// it returns the error of the first failed stage, if any
+func (p *Pipeline) Run(g *Graph) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	nodes := g.nodes
+	buffers := make([]bufferConfig, len(nodes))
+	for i, node := range nodes {
+		buffers[i] = p.bufferFor(i)
+		if err := buffers[i].validate(); err != nil {
+			return &StageError{i, node.name, err}
+		}
+	}
+
+	if p.checkpoint != nil {
+		if err := g.checkpointable(); err != nil {
+			return err
+		}
+	}
+
+	// Every edge gets its own channel, so each downstream stage sees all items
+	ins := make([][]chan *item, len(nodes))
+	outs := make([][]chan *item, len(nodes))
+	for i, node := range nodes {
+		for _, next := range node.to {
+			ch := make(chan *item, buffers[i].size)
+			outs[i] = append(outs[i], ch)
+			ins[next] = append(ins[next], ch)
+		}
+	}
+
+	stages := make([]*stageStats, len(nodes))
+	for i, node := range nodes {
+		stages[i] = newStageStats(i, node.name, outs[i])
+	}
+
+	p.mu.Lock()
+	p.stages = stages
+	p.mu.Unlock()
+
+	wg := &sync.WaitGroup{}
+	errs := make([]error, len(nodes))
+	abort := newAbortSignal()
+	var lastTrace uint64
+
+	log := p.logger
+	if log == nil {
+		log = currentLogger()
+	}
+
+	for i, node := range nodes {
+		run := &stageRun{
+			j:          node.j,
+			fn:         node.fn,
+			workers:    node.workers,
+			retry:      node.retry,
+			batch:      node.batch,
+			unbatch:    node.unbatch,
+			st:         stages[i],
+			policy:     buffers[i].policy,
+			ins:        ins[i],
+			outs:       outs[i],
+			deadLetter: p.deadLetter,
+			checkpoint: p.checkpoint,
+			tracer:     p.tracer,
+			log:        log,
+			abort:      abort,
+			lastTrace:  &lastTrace,
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			start := time.Now()
+			switch {
+			case run.fn != nil:
+				errs[i] = run.runMap()
+			case run.batch != nil:
+				errs[i] = run.runBatch()
+			case run.unbatch:
+				errs[i] = run.runUnbatch()
+			default:
+				errs[i] = run.run()
+			}
+			if errs[i] != nil {
+				abort.fire()
+			}
+
+			st := stages[i].snapshot()
+			fields := []Field{F("stage", st.Name), F("in", st.In), F("out", st.Out), F("duration", time.Since(start))}
+			if errs[i] != nil {
+				log.Log(LevelError, "stage failed", append(fields, F("error", errs[i]))...)
+			} else {
+				log.Log(LevelInfo, "stage done", fields...)
+			}
+		}(i)
+	}
+
+	stopReport := p.startReport()
+	stopCheckpoint := p.startCheckpoint()
+	wg.Wait()
+	stopReport()
+	cpErr := stopCheckpoint()
+
+	for i, err := range errs {
+		if err != nil {
+			return &StageError{i, stages[i].name, err}
+		}
+	}
+	return cpErr
+}
+
+// Snapshot returns the current metrics of the last (or running) execution
+func (p *Pipeline) Snapshot() []StageSnapshot {
+	p.mu.Lock()
+	stages := p.stages
+	p.mu.Unlock()
+
+	result := make([]StageSnapshot, len(stages))
+	for i, st := range stages {
+		result[i] = st.snapshot()
+	}
+	return result
+}
+
+func (p *Pipeline) startReport() func() {
+	if p.reportTo == nil || p.reportEvery <= 0 {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(p.reportEvery)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				WriteReport(p.reportTo, p.Snapshot())
+			case <-stop:
+				WriteReport(p.reportTo, p.Snapshot())
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func jobName(j job) string {
+	fn := runtime.FuncForPC(reflect.ValueOf(j).Pointer())
+	if fn == nil {
+		return "job"
+	}
+	name := fn.Name()
+	return name[strings.LastIndex(name, "/")+1:]
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// PanicError is a panic recovered from a stage job
+type PanicError struct {
+	Value interface{}
+	// Item the job was working on. Jobs don't say which item caused the panic,
+	// so unless the job used itemGroup it is the last item the job has received.
+	Item  interface{}
+	Stack []byte
+
+	// item of a keyed job
+	src *item
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.Value)
+}
+
+// Unwrap returns the value of the panic if it is an error
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// DeadLetter is an item which made a stage panic or a Map stage function fail
+type DeadLetter struct {
+	Stage int
+	Name  string
+	Item  interface{}
+	Err   error
+}
+
+// WithDeadLetter sends items which made a stage fail to sink instead of failing the pipeline,
+// the stage job is started again for the rest of its input. Only Map stages and jobs which
+// process items with itemGroup are started again: other jobs may keep what they have taken,
+// like CombineResults does, and it would be lost, so their panics still fail the pipeline.
+// sink is called from stage goroutines, so it may be called concurrently.
+func WithDeadLetter(sink func(DeadLetter)) PipelineOption {
+	return func(p *Pipeline) {
+		p.deadLetter = sink
+	}
+}
+
+// invoke calls the job and returns panics raised by it,
+// perItem tells that they come from items of an itemGroup
+func invoke(j job, in, out chan interface{}) (perrs []*PanicError, perItem bool) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		switch v := r.(type) {
+		case []*PanicError:
+			perrs, perItem = v, true
+		case *PanicError:
+			perrs = []*PanicError{v}
+		default:
+			perrs = []*PanicError{{Value: r, Stack: debug.Stack()}}
+		}
+	}()
+
+	j(in, out)
+	return nil, false
+}
+
+// itemGroup runs per-item goroutines of a job and sends their results to out. Their panics
+// can't be recovered by the pipeline, so they are collected and raised again by Wait
+// in the job goroutine, together with the items.
+// A job which keeps nothing between items but the group can be started again after a panic.
+// The group tells the stage which item every result comes from, so a job which calls Go
+// for every item it takes can be marked keyed.
+type itemGroup struct {
+	out chan interface{}
+	wg  *sync.WaitGroup
+
+	mu     *sync.Mutex
+	panics []*PanicError
+}
+
+func newItemGroup(out chan interface{}) *itemGroup {
+	return &itemGroup{out: out, wg: &sync.WaitGroup{}, mu: &sync.Mutex{}}
+}
+
+// Go calls fn for the item in a new goroutine and sends its result to out
+func (g *itemGroup) Go(val interface{}, fn func(val interface{}) interface{}) {
+	value, src := itemValue(val)
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			perr, ok := r.(*PanicError)
+			if !ok {
+				perr = &PanicError{Value: r, Stack: debug.Stack()}
+			}
+			perr.Item, perr.src = value, src
+
+			g.mu.Lock()
+			g.panics = append(g.panics, perr)
+			g.mu.Unlock()
+		}()
+		g.out <- itemOutput(fn(value), src)
+	}()
+}
+
+// Failed tells that some item has panicked, the job should stop taking new items
+func (g *itemGroup) Failed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.panics) > 0
+}
+
+func (g *itemGroup) Wait() {
+	g.wg.Wait()
+	if len(g.panics) > 0 {
+		panic(g.panics)
+	}
+}
+
+// Join waits for the goroutines without raising their panics. Jobs defer it,
+// so a job which panics itself doesn't leave goroutines writing to its output.
+func (g *itemGroup) Join() {
+	g.wg.Wait()
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestPanicInMultiHash(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	err := ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			out <- 1
+		}),
+		job(MultiHash),
+		job(CombineResults),
+	)
+
+	stageErr, ok := err.(*StageError)
+	if !ok || stageErr.Stage != 1 {
+		t.Fatalf("expected failure of stage 1, got %v", err)
+	}
+	var perr *PanicError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected panic error, got %v", err)
+	}
+	if perr.Item != 1 || !bytes.Contains(perr.Stack, []byte("NewMultiHash")) {
+		t.Errorf("panic should carry the item and the stack, got %v\n%s", perr.Item, perr.Stack)
+	}
+}
+
+func TestPanicAbortsPipeline(t *testing.T) {
+	var got []interface{}
+
+	err := ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < 1000; i++ {
+				out <- i
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				if val == 3 {
+					panic("boom")
+				}
+				out <- strconv.Itoa(val.(int))
+			}
+		}),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				got = append(got, val)
+			}
+		}),
+	)
+
+	var perr *PanicError
+	if !errors.As(err, &perr) || perr.Value != "boom" || perr.Item != 3 {
+		t.Fatalf("expected panic on item 3, got %v", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("aborted pipeline should not produce results, got %v", got)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	mu := &sync.Mutex{}
+	var letters []DeadLetter
+	var result string
+
+	p := NewPipeline(WithDeadLetter(func(dl DeadLetter) {
+		mu.Lock()
+		letters = append(letters, dl)
+		mu.Unlock()
+	}))
+
+	err := p.Execute(
+		job(func(in, out chan interface{}) {
+			out <- 0
+			out <- "bad"
+			out <- 1
+		}),
+		job(SingleHash),
+		job(MultiHash),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			result = (<-in).(string)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(letters) != 1 || letters[0].Stage != 1 || letters[0].Item != "bad" {
+		t.Fatalf("expected bad item from stage 1, got %+v", letters)
+	}
+	if expected := signInts([]int{0, 1}); result != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", result, expected)
+	}
+	if st := p.Snapshot()[1]; st.Panics != 1 {
+		t.Errorf("expected a panic in metrics, got %d", st.Panics)
+	}
+}
+
+func TestDeadLetterRestartsJob(t *testing.T) {
+	mu := &sync.Mutex{}
+	var letters []DeadLetter
+	var got []int
+
+	err := NewPipeline(WithDeadLetter(func(dl DeadLetter) {
+		mu.Lock()
+		letters = append(letters, dl)
+		mu.Unlock()
+	})).Execute(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < 5; i++ {
+				out <- i
+			}
+		}),
+		job(func(in, out chan interface{}) {
+			items := newItemGroup(out)
+			for val := range in {
+				items.Go(val, func(val interface{}) interface{} {
+					if val.(int)%2 == 1 {
+						panic("odd")
+					}
+					return val
+				})
+				if items.Failed() {
+					break
+				}
+			}
+			items.Wait()
+		}),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				got = append(got, val.(int))
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Item.(int) < letters[j].Item.(int) })
+	if len(got) != 3 || len(letters) != 2 || letters[0].Item != 1 || letters[1].Item != 3 {
+		t.Errorf("expected even items to pass and odd to be dead, got %v and %+v", got, letters)
+	}
+}
+
+func TestDeadLetterStatefulJob(t *testing.T) {
+	var letters []DeadLetter
+	var result interface{}
+
+	// CombineResults has taken a and b when it panics on 3,
+	// starting it again would lose them
+	err := NewPipeline(WithDeadLetter(func(dl DeadLetter) {
+		letters = append(letters, dl)
+	})).Execute(
+		job(func(in, out chan interface{}) {
+			for _, val := range []interface{}{"a", "b", 3, "c"} {
+				out <- val
+			}
+		}),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				result = val
+			}
+		}),
+	)
+
+	stageErr, ok := err.(*StageError)
+	var perr *PanicError
+	if !ok || stageErr.Stage != 1 || !errors.As(err, &perr) || perr.Item != 3 {
+		t.Fatalf("expected a panic of stage 1 on item 3, got %v", err)
+	}
+	if len(letters) != 0 || result != nil {
+		t.Errorf("expected no dead letters and no result, got %+v and %v", letters, result)
+	}
+}
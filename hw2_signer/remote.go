@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// remoteFrame is what stage workers and RemoteStage send to each other.
+// Values go through encoding/gob, types other than the basic ones must be registered with gob.Register.
+type remoteFrame struct {
+	Value interface{}
+	// Err is set by the worker when its job has failed
+	Err string
+	// End is the last frame in both directions
+	End bool
+}
+
+var remoteDialTimeout = 5 * time.Second
+
+// ServeStage runs the job for items coming from every connection accepted on l,
+// results are sent back over the same connection. It returns when l is closed.
+func ServeStage(l net.Listener, j job) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(conn, j)
+	}
+}
+
+func serveConn(conn net.Conn, j job) {
+	defer conn.Close()
+	enc := gob.NewEncoder(conn)
+	dec := gob.NewDecoder(conn)
+
+	in := make(chan interface{})
+	out := make(chan interface{})
+	jobDone := make(chan []*PanicError, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		defer close(in)
+		for {
+			var f remoteFrame
+			if err := dec.Decode(&f); err != nil || f.End {
+				return
+			}
+			select {
+			case in <- f.Value:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	go func() {
+		perrs, _ := invoke(j, in, out)
+		jobDone <- perrs
+	}()
+
+	var sendErr error
+	for {
+		select {
+		case val := <-out:
+			if sendErr != nil {
+				continue
+			}
+			if sendErr = enc.Encode(remoteFrame{Value: val}); sendErr != nil {
+				// The client is gone or the value can't be encoded,
+				// closing the connection makes the job run out of input
+				enc.Encode(remoteFrame{Err: sendErr.Error()})
+				conn.Close()
+			}
+		case perrs := <-jobDone:
+			close(out)
+			if sendErr != nil {
+				return
+			}
+			if len(perrs) > 0 {
+				enc.Encode(remoteFrame{Err: perrs[0].Error()})
+				return
+			}
+			enc.Encode(remoteFrame{End: true})
+			return
+		}
+	}
+}
+
+// RemoteStage is a job which sends its input to stage workers (see ServeStage) listening on addrs
+// and passes on their results. Every worker connection takes the next item as soon as
+// the previous one is written to the socket, so the items are spread by how fast the
+// connections take them, not by the load of the workers, and the order of results is not kept. Failures of the connection or of a worker job
+// make the stage panic, so the pipeline fails as it does when a local job panics.
+func RemoteStage(network string, addrs ...string) job {
+	return func(in, out chan interface{}) {
+		if len(addrs) == 0 {
+			panic(errors.New("remote stage has no workers"))
+		}
+
+		r := &remoteRun{failed: make(chan struct{})}
+		for _, addr := range addrs {
+			conn, err := net.DialTimeout(network, addr, remoteDialTimeout)
+			if err != nil {
+				r.closeAll()
+				panic(err)
+			}
+			r.conns = append(r.conns, conn)
+		}
+
+		work := make(chan interface{})
+		wg := &sync.WaitGroup{}
+		for i, conn := range r.conns {
+			wg.Add(2)
+			go func(addr string, conn net.Conn) {
+				defer wg.Done()
+				r.send(addr, gob.NewEncoder(conn), work)
+			}(addrs[i], conn)
+			go func(addr string, conn net.Conn) {
+				defer wg.Done()
+				r.receive(addr, gob.NewDecoder(conn), out)
+			}(addrs[i], conn)
+		}
+
+	feed:
+		for val := range in {
+			select {
+			case work <- val:
+			case <-r.failed:
+				break feed
+			}
+		}
+		close(work)
+
+		wg.Wait()
+		r.closeAll()
+		if err := r.error(); err != nil {
+			panic(err)
+		}
+	}
+}
+
+type remoteRun struct {
+	conns []net.Conn
+
+	mu      sync.Mutex
+	err     error
+	sendErr error
+	failed  chan struct{}
+	once    sync.Once
+}
+
+func (r *remoteRun) send(addr string, enc *gob.Encoder, work <-chan interface{}) {
+	for val := range work {
+		if err := enc.Encode(remoteFrame{Value: val}); err != nil {
+			// The worker may have failed and closed the connection,
+			// its own error is what we want to report, so keep the connection for reading
+			r.mu.Lock()
+			if r.sendErr == nil {
+				r.sendErr = fmt.Errorf("remote stage %s: %v", addr, err)
+			}
+			r.mu.Unlock()
+			r.once.Do(func() { close(r.failed) })
+
+			for range work {
+			}
+			break
+		}
+	}
+	enc.Encode(remoteFrame{End: true})
+}
+
+func (r *remoteRun) receive(addr string, dec *gob.Decoder, out chan<- interface{}) {
+	for {
+		var f remoteFrame
+		if err := dec.Decode(&f); err != nil {
+			r.fail(addr, err)
+			return
+		}
+		switch {
+		case f.Err != "":
+			r.fail(addr, errors.New(f.Err))
+			return
+		case f.End:
+			return
+		}
+		out <- f.Value
+	}
+}
+
+// fail remembers the first error and closes all connections,
+// so nobody stays blocked on a worker which won't answer
+func (r *remoteRun) fail(addr string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.err = fmt.Errorf("remote stage %s: %v", addr, err)
+	r.once.Do(func() { close(r.failed) })
+	r.closeAll()
+}
+
+func (r *remoteRun) error() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	return r.sendErr
+}
+
+func (r *remoteRun) closeAll() {
+	for _, conn := range r.conns {
+		conn.Close()
+	}
+}
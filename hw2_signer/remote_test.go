@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func startWorker(t *testing.T, network, addr string, j job) (string, func()) {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ServeStage(l, j)
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestRemoteStage(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	addr1, stop1 := startWorker(t, "tcp", "127.0.0.1:0", MultiHash)
+	defer stop1()
+	addr2, stop2 := startWorker(t, "tcp", "127.0.0.1:0", MultiHash)
+	defer stop2()
+
+	input := []int{0, 1, 1, 2, 3, 5, 8}
+	var result string
+	err := ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for _, val := range input {
+				out <- val
+			}
+		}),
+		job(SingleHash),
+		RemoteStage("tcp", addr1, addr2),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			result = (<-in).(string)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != signInts(input) {
+		t.Errorf("remote result differs from local one:\n%s\n%s", result, signInts(input))
+	}
+}
+
+func TestRemoteStageUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	addr, stop := startWorker(t, "unix", filepath.Join(dir, "worker.sock"), func(in, out chan interface{}) {
+		for val := range in {
+			out <- strings.ToUpper(val.(string))
+		}
+	})
+	defer stop()
+
+	var got []string
+	err = ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			out <- "a"
+			out <- "b"
+		}),
+		RemoteStage("unix", addr),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				got = append(got, val.(string))
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(got, "") != "AB" {
+		t.Errorf("unexpected results %v", got)
+	}
+}
+
+func TestRemoteStageFailure(t *testing.T) {
+	addr, stop := startWorker(t, "tcp", "127.0.0.1:0", func(in, out chan interface{}) {
+		for val := range in {
+			if val == 3 {
+				panic("worker is broken")
+			}
+			out <- val
+		}
+	})
+	defer stop()
+
+	err := ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for i := 0; i < 100; i++ {
+				out <- i
+			}
+		}),
+		RemoteStage("tcp", addr),
+		job(func(in, out chan interface{}) {
+			for range in {
+			}
+		}),
+	)
+	stageErr, ok := err.(*StageError)
+	if !ok || stageErr.Stage != 1 || !strings.Contains(err.Error(), "worker is broken") {
+		t.Fatalf("expected the worker failure in stage 1, got %v", err)
+	}
+
+	// Nobody listens there anymore
+	stop()
+	err = ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			out <- 1
+		}),
+		RemoteStage("tcp", addr),
+	)
+	if err == nil {
+		t.Error("expected a dial error")
+	}
+}
+
+func TestServeConnLeavesNoGoroutines(t *testing.T) {
+	upper := func(in, out chan interface{}) {
+		for val := range in {
+			out <- strings.ToUpper(val.(string))
+		}
+	}
+	before := runtime.NumGoroutine()
+
+	for i := 0; i < 20; i++ {
+		client, server := net.Pipe()
+		go serveConn(server, upper)
+
+		enc, dec := gob.NewEncoder(client), gob.NewDecoder(client)
+		if err := enc.Encode(remoteFrame{Value: "a"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := enc.Encode(remoteFrame{End: true}); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			var f remoteFrame
+			if err := dec.Decode(&f); err != nil {
+				t.Fatal(err)
+			}
+			if f.End {
+				break
+			}
+			if f.Value != "A" {
+				t.Errorf("unexpected result %v", f.Value)
+			}
+		}
+		client.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines before connections, %d after", before, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const defaultMaxBackoff = time.Minute
+
+// RetryPolicy tells a Map stage how to call its function again for items which fail
+type RetryPolicy struct {
+	// Attempts is the number of calls for an item including the first one
+	Attempts int
+	// Backoff is the pause before the second call, it doubles for every next one
+	// up to MaxBackoff (a minute if not set)
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Jitter makes pauses up to this fraction shorter, so failed items don't come back all at once
+	Jitter float64
+	// Retryable tells which errors are worth another call, IsRetryable if not set
+	Retryable func(err error) bool
+}
+
+// RetryError is the error of the last call for an item which has been tried several times
+type RetryError struct {
+	Attempts int
+	Err      error
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+type retryableError struct {
+	error
+}
+
+func (e retryableError) Temporary() bool {
+	return true
+}
+
+func (e retryableError) Unwrap() error {
+	return e.error
+}
+
+// Retryable marks err as temporary, so IsRetryable lets the item be tried again
+func Retryable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return retryableError{err}
+}
+
+// IsRetryable reports whether err or an error it wraps says it is temporary, like network errors
+// or errors marked with Retryable. Panics are retried only if they panic with such an error.
+func IsRetryable(err error) bool {
+	var temp interface {
+		Temporary() bool
+	}
+	return errors.As(err, &temp) && temp.Temporary()
+}
+
+func (p *RetryPolicy) validate() error {
+	if p.Attempts < 1 {
+		return fmt.Errorf("retry needs at least one attempt, got %d", p.Attempts)
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return fmt.Errorf("negative backoff")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+	return nil
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// backoff returns the pause after the given failed attempt
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	max := p.MaxBackoff
+	if max == 0 {
+		max = defaultMaxBackoff
+	}
+
+	d := p.Backoff
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	if p.Jitter > 0 {
+		d -= time.Duration(p.Jitter * rand.Float64() * float64(d))
+	}
+	return d
+}
+
+// Retry makes a Map stage call its function again for items which fail with a retryable error,
+// jobs can't be retried as the runtime can't give an item back to them
+func (g *Graph) Retry(name string, policy RetryPolicy) *Graph {
+	idx, ok := g.byName[name]
+	if !ok {
+		g.fail(fmt.Errorf("retry: unknown stage %q", name))
+		return g
+	}
+	if g.nodes[idx].fn == nil {
+		g.fail(fmt.Errorf("retry: stage %q is not a Map stage", name))
+		return g
+	}
+	if err := policy.validate(); err != nil {
+		g.fail(fmt.Errorf("retry %s: %v", name, err))
+		return g
+	}
+	g.nodes[idx].retry = &policy
+	return g
+}
+
+// call runs the stage function for an item as many times as the retry policy allows,
+// pauses between calls are cut short when the pipeline is aborted
+func (r *stageRun) call(data interface{}) (interface{}, error) {
+	for attempt := 1; ; attempt++ {
+		res, err := callItem(r.fn, data)
+		if err == nil || r.retry == nil || attempt >= r.retry.Attempts || !r.retry.retryable(err) {
+			r.st.attempted(attempt)
+			if err != nil && attempt > 1 {
+				err = &RetryError{Attempts: attempt, Err: err}
+			}
+			return res, err
+		}
+
+		backoff := r.retry.backoff(attempt)
+		r.log.Log(LevelDebug, "retrying item", F("stage", r.st.name), F("attempt", attempt), F("backoff", backoff), F("error", err))
+
+		select {
+		case <-SignerClock.After(backoff):
+		case <-r.abort.done:
+			r.st.attempted(attempt)
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flaky fails items from failing as many times as given there
+type flaky struct {
+	mu      sync.Mutex
+	calls   map[int]int
+	failing map[int]int
+	err     func() error
+}
+
+func newFlaky(failing map[int]int, err func() error) *flaky {
+	return &flaky{calls: make(map[int]int), failing: failing, err: err}
+}
+
+func (f *flaky) call(data interface{}) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	val := data.(int)
+	f.calls[val]++
+	if f.calls[val] <= f.failing[val] {
+		return nil, f.err()
+	}
+	return val, nil
+}
+
+func runFlaky(f *flaky, policy RetryPolicy) (*Pipeline, []int, error) {
+	var got []int
+	g := NewGraph().
+		Stage("source", countTo(5)).
+		Map("flaky", f.call, 2).
+		Retry("flaky", policy).
+		Stage("sink", func(in, out chan interface{}) {
+			for val := range in {
+				got = append(got, val.(int))
+			}
+		}).
+		Chain("source", "flaky", "sink")
+
+	p := NewPipeline()
+	err := p.Run(g)
+	return p, got, err
+}
+
+func TestRetry(t *testing.T) {
+	f := newFlaky(map[int]int{1: 1, 3: 2}, func() error {
+		return Retryable(errors.New("signer is busy"))
+	})
+	p, got, err := runFlaky(f, RetryPolicy{Attempts: 3, Backoff: time.Millisecond, Jitter: 0.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 5 {
+		t.Errorf("expected all items, got %v", got)
+	}
+
+	st := p.Snapshot()[1]
+	if st.Retries != 3 || len(st.Attempts) != 3 ||
+		st.Attempts[0] != 3 || st.Attempts[1] != 1 || st.Attempts[2] != 1 {
+		t.Errorf("unexpected attempts %v, retries %d", st.Attempts, st.Retries)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	f := newFlaky(map[int]int{2: 10}, func() error {
+		return Retryable(errors.New("signer is busy"))
+	})
+	_, _, err := runFlaky(f, RetryPolicy{Attempts: 3, Backoff: time.Millisecond})
+
+	var rerr *RetryError
+	if !errors.As(err, &rerr) || rerr.Attempts != 3 {
+		t.Fatalf("expected retry error after 3 attempts, got %v", err)
+	}
+	if f.calls[2] != 3 {
+		t.Errorf("expected 3 calls, got %d", f.calls[2])
+	}
+}
+
+func TestRetryClassification(t *testing.T) {
+	f := newFlaky(map[int]int{2: 1}, func() error {
+		return errors.New("bad data")
+	})
+	_, _, err := runFlaky(f, RetryPolicy{Attempts: 3})
+	if err == nil || f.calls[2] != 1 {
+		t.Errorf("permanent error should not be retried, got %d calls and %v", f.calls[2], err)
+	}
+
+	f = newFlaky(map[int]int{2: 1}, func() error {
+		panic(Retryable(errors.New("overheat")))
+	})
+	if _, _, err := runFlaky(f, RetryPolicy{Attempts: 2}); err != nil {
+		t.Errorf("panic with a retryable error should be retried, got %v", err)
+	}
+
+	f = newFlaky(map[int]int{2: 1}, func() error {
+		return errors.New("bad data")
+	})
+	_, _, err = runFlaky(f, RetryPolicy{Attempts: 2, Retryable: func(error) bool { return true }})
+	if err != nil {
+		t.Errorf("custom classification is ignored: %v", err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	c, restore := fakeClock()
+	defer restore()
+
+	f := newFlaky(map[int]int{0: 2}, func() error {
+		return Retryable(errors.New("signer is busy"))
+	})
+	done := make(chan error)
+	go func() {
+		_, _, err := runFlaky(f, RetryPolicy{Attempts: 3, Backoff: time.Second})
+		done <- err
+	}()
+
+	step(t, c, 1, time.Second)
+	step(t, c, 1, 2*time.Second)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	p := RetryPolicy{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	for i, expected := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if d := p.backoff(i + 1); d != expected*time.Millisecond {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, expected*time.Millisecond, d)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if d := p.backoff(1); d < 50*time.Millisecond || d > 100*time.Millisecond {
+			t.Fatalf("jitter out of range: %s", d)
+		}
+	}
+}
+
+func TestRetryValidation(t *testing.T) {
+	fn := func(data interface{}) (interface{}, error) { return data, nil }
+	for _, g := range []*Graph{
+		NewGraph().Map("a", fn, 1).Retry("b", RetryPolicy{Attempts: 2}),
+		NewGraph().Stage("a", countTo(1)).Retry("a", RetryPolicy{Attempts: 2}),
+		NewGraph().Map("a", fn, 1).Retry("a", RetryPolicy{}),
+		NewGraph().Map("a", fn, 1).Retry("a", RetryPolicy{Attempts: 2, Jitter: 2}),
+	} {
+		if g.Validate() == nil {
+			t.Errorf("expected an error for %+v", g.nodes)
+		}
+	}
+}
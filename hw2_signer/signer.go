@@ -1,155 +1,210 @@
-package hw3
+package main
 
 import (
-	"fmt"
-	"sort"
+	"runtime/debug"
 	"strconv"
 	"strings"
-	"sync"
 )
 
 // сюда писать код
 func SingleHash(in, out chan interface{}) {
+	NewSingleHash(defaultScheme)(in, out)
+}
 
-	wg := &sync.WaitGroup{}
-	quota := make(chan struct{}, 1)
-
-	for val := range in {
+func init() {
+	// Jobs made by NewSingleHash and NewMultiHash are marked when they are made
+	keyed(SingleHash)
+	keyed(MultiHash)
+	keyed(CombineResults)
+}
 
-		wg.Add(1)
+// NewSingleHash builds a SingleHash job which computes
+// Outer(data) + "~" + Outer(Inner(data)) with signers of the scheme
+func NewSingleHash(scheme *HashScheme) job {
+	return keyed(func(in, out chan interface{}) {
 
-		data := strconv.Itoa(val.(int))
+		items := newItemGroup(out)
+		defer items.Join()
+		quota := make(chan struct{}, 1)
 
-		go func(data string, out chan interface{}) {
-			defer wg.Done()
+		for val := range in {
 
-			crc32 := crc32worker(data)
-			md5chan := md5worker(data, quota)
-			crc32md5 := crc32worker(<-md5chan)
+			items.Go(val, func(val interface{}) interface{} {
+				return singleHash(scheme, val, quota)
+			})
 
-			result := <-crc32 + "~" + <-crc32md5
+			// Stop taking new items after a panic, so they can go to a restarted job
+			if items.Failed() {
+				break
+			}
+		}
 
-			out <- result
+		items.Wait()
+	})
+}
 
-		}(data, out)
+func singleHash(scheme *HashScheme, val interface{}, quota chan struct{}) string {
+	return singleHashData(scheme, strconv.Itoa(val.(int)), quota)
+}
 
-	}
+// singleHashData is SingleHash of data which is a string already, like lines of the command line
+func singleHashData(scheme *HashScheme, data string, quota chan struct{}) string {
+	outer := signWorker(scheme.Outer, data, quota)
+	inner := signWorker(scheme.Inner, data, quota)
+	outerInner := signWorker(scheme.Outer, (<-inner).get(), quota)
 
-	wg.Wait()
+	return (<-outer).get() + "~" + (<-outerInner).get()
 }
 
-func md5worker(data string, quota chan struct{}) chan string {
-	out := make(chan string, 1)
-	go func(out chan<- string) {
-		quota <- struct{}{}
+// SingleHashFunc is SingleHash of a single item for Map stages,
+// all its calls share the quota for signers which can't run concurrently
+func SingleHashFunc(scheme *HashScheme) ItemFunc {
+	quota := make(chan struct{}, 1)
+	return func(val interface{}) (interface{}, error) {
+		return singleHash(scheme, val, quota), nil
+	}
+}
 
-		out <- DataSignerMd5(data)
+// signed is a result of a background signer call,
+// get raises the signer panic in the goroutine which needs the result
+type signed struct {
+	result string
+	perr   *PanicError
+}
 
-		<-quota
-	}(out)
+func (s signed) get() string {
+	if s.perr != nil {
+		panic(s.perr)
+	}
+	return s.result
+}
 
-	return out
+func sign(signer Signer, data string) (res signed) {
+	defer func() {
+		if r := recover(); r != nil {
+			res.perr = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return signed{result: signer.Sign(data)}
 }
 
-func crc32worker(data string) chan string {
-	out := make(chan string, 1)
-	go func(out chan<- string) {
-		out <- DataSignerCrc32(data)
+// signWorker signs data in background, signers which can't run concurrently
+// wait for the quota
+func signWorker(signer Signer, data string, quota chan struct{}) chan signed {
+	out := make(chan signed, 1)
+	go func(out chan<- signed) {
+		if isExclusive(signer) {
+			quota <- struct{}{}
+			defer func() { <-quota }()
+		}
+
+		out <- sign(signer, data)
 	}(out)
-	return out
-
-}
 
-type crc2th struct {
-	th     int
-	result string
+	return out
 }
 
-func dcrc32(out chan crc2th, th int, data string) {
-
-	out <- crc2th{th, DataSignerCrc32(data)}
+type sign2th struct {
+	th int
+	signed
 }
 
-func distributedCrc32(data []string) []string {
+// distributedSign signs all data in parallel, signers which can't run concurrently
+// take turns
+func distributedSign(signer Signer, data []string) []string {
 
-	crc2chan := make(chan crc2th, len(data))
+	signChan := make(chan sign2th, len(data))
 	results := make([]string, len(data))
+	quota := make(chan struct{}, 1)
 
 	for th, val := range data {
-		go dcrc32(crc2chan, th, val)
+		go func(th int, val string) {
+			if isExclusive(signer) {
+				quota <- struct{}{}
+				defer func() { <-quota }()
+			}
+			signChan <- sign2th{th, sign(signer, val)}
+		}(th, val)
 	}
 
+	var perr *PanicError
 	for th := 0; th < len(data); th++ {
-		res := <-crc2chan
+		res := <-signChan
 		results[res.th] = res.result
+		if res.perr != nil {
+			perr = res.perr
+		}
 	}
 
+	if perr != nil {
+		panic(perr)
+	}
 	return results
 }
 
 func MultiHash(in, out chan interface{}) {
+	NewMultiHash(defaultScheme)(in, out)
+}
 
-	wg := &sync.WaitGroup{}
+// NewMultiHash builds a MultiHash job which concatenates
+// Multi(th + data) for th from 0 to Rounds-1
+func NewMultiHash(scheme *HashScheme) job {
+	return keyed(func(in, out chan interface{}) {
 
-	for val := range in {
+		items := newItemGroup(out)
+		defer items.Join()
 
-		fmt.Println("Multi Hash got ", val)
+		for val := range in {
 
-		data := val.(string)
+			data, _ := itemValue(val)
+			currentLogger().Log(LevelDebug, "MultiHash got item", F("stage", "MultiHash"), F("data", data))
 
-		wg.Add(1)
-		go func(data string, out chan interface{}) {
-			defer wg.Done()
-			inputData := make([]string, 6)
-			for th := 0; th < 6; th++ {
-				inputData[th] = strconv.Itoa(th) + data
-			}
+			items.Go(val, func(val interface{}) interface{} {
+				return multiHash(scheme, val)
+			})
 
-			resultsData := distributedCrc32(inputData)
+			if items.Failed() {
+				break
+			}
+		}
+		items.Wait()
+	})
+}
 
-			out <- strings.Join(resultsData, "")
-		}(data, out)
+func multiHash(scheme *HashScheme, val interface{}) string {
+	data := val.(string)
+	inputData := make([]string, scheme.Rounds)
+	for th := 0; th < scheme.Rounds; th++ {
+		inputData[th] = strconv.Itoa(th) + data
 	}
-	wg.Wait()
 
+	resultsData := distributedSign(scheme.Multi, inputData)
+
+	return strings.Join(resultsData, "")
+}
+
+// MultiHashFunc is MultiHash of a single item for Map stages
+func MultiHashFunc(scheme *HashScheme) ItemFunc {
+	return func(val interface{}) (interface{}, error) {
+		return multiHash(scheme, val), nil
+	}
 }
 
 func CombineResults(in, out chan interface{}) {
 
 	var results []string
+	var from []*item
 
 	for val := range in {
-		results = append(results, val.(string))
+		data, src := itemValue(val)
+		results = append(results, data.(string))
+		from = append(from, src)
 	}
 
-	sort.Strings(results)
-	result := strings.Join(results, "_")
-
 	// Join results into one string and send it to out channel
-	out <- result
+	out <- itemOutput(combine(results), from...)
 }
 
-func ExecutePipeline(jobs ...job) {
-
-	wg := &sync.WaitGroup{}
-	var in chan interface{}
-
-	for _, newJob := range jobs {
-
-		wg.Add(1)
-
-		out := make(chan interface{}, 100)
-
-		go func(j job, in, out chan interface{}) {
-			defer wg.Done()
-			j(in, out)
-			close(out)
-		}(newJob, in, out)
-
-		// Swap channels
-		in = out
-	}
-
-	wg.Wait()
-
+func ExecutePipeline(jobs ...job) error {
+	return NewPipeline().Execute(jobs...)
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Signer computes a digest of data
+type Signer interface {
+	Sign(data string) string
+}
+
+type SignerFunc func(data string) string
+
+func (f SignerFunc) Sign(data string) string {
+	return f(data)
+}
+
+// exclusiveSigner wraps signers which overheat if called concurrently, like DataSignerMd5
+type exclusiveSigner struct {
+	Signer
+}
+
+func isExclusive(s Signer) bool {
+	_, ok := s.(exclusiveSigner)
+	return ok
+}
+
+// SignerFactory builds a signer, key is only used by keyed algorithms
+type SignerFactory func(key string) (Signer, error)
+
+var (
+	signersMu sync.RWMutex
+	signers   = make(map[string]SignerFactory)
+)
+
+func RegisterSigner(name string, factory SignerFactory) {
+	signersMu.Lock()
+	defer signersMu.Unlock()
+	signers[name] = factory
+}
+
+func NewSigner(name, key string) (Signer, error) {
+	signersMu.RLock()
+	factory, ok := signers[name]
+	signersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown signer %q", name)
+	}
+	return factory(key)
+}
+
+// ParseSigner builds a signer from "name" or "name:key" spec, e.g. "hmac:secret"
+func ParseSigner(spec string) (Signer, error) {
+	name, key := spec, ""
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, key = spec[:i], spec[i+1:]
+	}
+	return NewSigner(name, key)
+}
+
+// Signers returns names of all registered signers
+func Signers() []string {
+	signersMu.RLock()
+	defer signersMu.RUnlock()
+
+	names := make([]string, 0, len(signers))
+	for name := range signers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func simpleSigner(s Signer) SignerFactory {
+	return func(key string) (Signer, error) {
+		return s, nil
+	}
+}
+
+// hexSigner signs data with a hash function, batches reuse one hash for all inputs
+type hexSigner func() hash.Hash
+
+func (newHash hexSigner) Sign(data string) string {
+	return newHash.SignBatch([]string{data})[0]
+}
+
+func (newHash hexSigner) SignBatch(data []string) []string {
+	h := newHash()
+	results := make([]string, len(data))
+	for i, d := range data {
+		h.Reset()
+		h.Write([]byte(d + DataSignerSalt))
+		results[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return results
+}
+
+func init() {
+	// md5 and crc32 go through the package variables (and the cache),
+	// so tests can still replace them
+	RegisterSigner("md5", simpleSigner(exclusiveSigner{SignerFunc(signMd5)}))
+	RegisterSigner("crc32", simpleSigner(SignerFunc(signCrc32)))
+
+	RegisterSigner("sha1", simpleSigner(hexSigner(sha1.New)))
+	RegisterSigner("sha256", simpleSigner(hexSigner(sha256.New)))
+	RegisterSigner("fnv", simpleSigner(SignerFunc(func(data string) string {
+		h := fnv.New64a()
+		h.Write([]byte(data + DataSignerSalt))
+		return strconv.FormatUint(h.Sum64(), 10)
+	})))
+	RegisterSigner("hmac", func(key string) (Signer, error) {
+		if key == "" {
+			return nil, fmt.Errorf("hmac signer needs a key")
+		}
+		return hexSigner(func() hash.Hash {
+			return hmac.New(sha256.New, []byte(key))
+		}), nil
+	})
+}
+
+// HashScheme tells SingleHash and MultiHash which signers to combine
+type HashScheme struct {
+	// SingleHash computes Outer(data) + "~" + Outer(Inner(data))
+	Outer Signer
+	Inner Signer
+	// MultiHash concatenates Multi(th + data) for th from 0 to Rounds-1
+	Multi  Signer
+	Rounds int
+}
+
+var defaultScheme = &HashScheme{
+	Outer:  SignerFunc(signCrc32),
+	Inner:  exclusiveSigner{SignerFunc(signMd5)},
+	Multi:  SignerFunc(signCrc32),
+	Rounds: 6,
+}
+
+// NewHashScheme builds a scheme from signer specs, see ParseSigner
+func NewHashScheme(outer, inner, multi string, rounds int) (*HashScheme, error) {
+	if rounds <= 0 {
+		return nil, fmt.Errorf("MultiHash needs at least one round")
+	}
+
+	scheme := &HashScheme{Rounds: rounds}
+	var err error
+	if scheme.Outer, err = ParseSigner(outer); err != nil {
+		return nil, err
+	}
+	if scheme.Inner, err = ParseSigner(inner); err != nil {
+		return nil, err
+	}
+	if scheme.Multi, err = ParseSigner(multi); err != nil {
+		return nil, err
+	}
+	return scheme, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func signWith(scheme *HashScheme, input []int) string {
+	var result string
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for _, val := range input {
+				out <- val
+			}
+		}),
+		NewSingleHash(scheme),
+		NewMultiHash(scheme),
+		job(CombineResults),
+		job(func(in, out chan interface{}) {
+			result = (<-in).(string)
+		}),
+	)
+	return result
+}
+
+func TestDefaultHashScheme(t *testing.T) {
+	calls, restore := fastSigners()
+	defer restore()
+
+	scheme, err := NewHashScheme("crc32", "md5", "crc32", 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "29568666068035183841425683795340791879727309630931025356555_4958044192186797981418233587017209679042592862002427381542"
+	if result := signWith(scheme, []int{0, 1}); result != expected {
+		t.Errorf("results not match\nGot: %v\nExpected: %v", result, expected)
+	}
+	if calls.md5 != 2 || calls.crc32 != 2*8 {
+		t.Errorf("registered signers should use DataSigner functions: %+v", calls)
+	}
+}
+
+func TestStrongHashScheme(t *testing.T) {
+	calls, restore := fastSigners()
+	defer restore()
+
+	scheme, err := NewHashScheme("sha256", "hmac:secret", "fnv", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := signWith(scheme, []int{0, 1, 2})
+	if result != signWith(scheme, []int{2, 1, 0}) {
+		t.Errorf("result should not depend on input order")
+	}
+	if result == signWith(defaultScheme, []int{0, 1, 2}) {
+		t.Errorf("result should depend on the scheme")
+	}
+	if calls.md5 != 3 {
+		t.Errorf("only the default scheme should call md5, got %d calls", calls.md5)
+	}
+}
+
+func TestExclusiveMultiSigner(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	signer := exclusiveSigner{SignerFunc(func(data string) string {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return data
+	})}
+
+	scheme := &HashScheme{Outer: signer, Inner: signer, Multi: signer, Rounds: 6}
+	if res := multiHash(scheme, "x"); res != "0x1x2x3x4x5x" {
+		t.Errorf("unexpected result %s", res)
+	}
+	if maxRunning != 1 {
+		t.Errorf("exclusive signer should not run concurrently, %d calls did", maxRunning)
+	}
+}
+
+func TestSignerRegistry(t *testing.T) {
+	for _, name := range []string{"crc32", "fnv", "hmac", "md5", "sha1", "sha256"} {
+		found := false
+		for _, registered := range Signers() {
+			found = found || registered == name
+		}
+		if !found {
+			t.Errorf("signer %s is not registered", name)
+		}
+	}
+
+	sha1, err := ParseSigner("sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := sha1.Sign("abc"); res != "a9993e364706816aba3e25717850c26c9cd0d89d" {
+		t.Errorf("wrong sha1 %s", res)
+	}
+
+	first, _ := ParseSigner("hmac:first")
+	second, _ := ParseSigner("hmac:second")
+	if first.Sign("abc") == second.Sign("abc") {
+		t.Errorf("hmac should depend on the key")
+	}
+
+	if _, err := ParseSigner("hmac"); err == nil {
+		t.Errorf("hmac without a key should fail")
+	}
+	if _, err := ParseSigner("rot13"); err == nil {
+		t.Errorf("unknown signer should fail")
+	}
+}
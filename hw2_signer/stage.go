@@ -0,0 +1,554 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// noSeq marks items which can't be traced back to a source item
+const noSeq = ^uint64(0)
+
+// item is what flows between stages: a value, the number of the source item it came from
+// and its trace ID. A Batch comes from all the source items of its elements.
+type item struct {
+	seq    uint64
+	seqs   []uint64
+	trace  uint64
+	traces []uint64
+	value  interface{}
+}
+
+// from gives env the identity of the item it is made from
+func (env *item) from(src *item) {
+	env.seq, env.seqs = src.seq, src.seqs
+	env.trace, env.traces = src.trace, src.traces
+}
+
+// join gives env the identity of all the items it is made from, like a Batch
+func (env *item) join(srcs []*item) {
+	if len(srcs) == 1 {
+		env.from(srcs[0])
+		return
+	}
+	env.seq, env.trace = noSeq, 0
+	for _, src := range srcs {
+		if src.seq != noSeq {
+			env.seqs = append(env.seqs, src.seq)
+		}
+		env.seqs = append(env.seqs, src.seqs...)
+		if src.trace != 0 {
+			env.traces = append(env.traces, src.trace)
+		}
+		env.traces = append(env.traces, src.traces...)
+	}
+}
+
+// keyedJobs are jobs which tell what items their results come from, see keyed
+var keyedJobs sync.Map
+
+// keyed marks jobs which take *item instead of values from a stage and send itemResult
+// for them, so the stage knows which items every result is made from. Jobs are told apart
+// by their code, so all jobs made by the same constructor are marked. Keyed jobs still
+// work with plain values, e.g. when they are served by a worker.
+func keyed(j job) job {
+	keyedJobs.Store(reflect.ValueOf(j).Pointer(), true)
+	return j
+}
+
+func isKeyed(j job) bool {
+	_, ok := keyedJobs.Load(reflect.ValueOf(j).Pointer())
+	return ok
+}
+
+// itemResult is a result of a keyed job with the items it is made from
+type itemResult struct {
+	from  []*item
+	value interface{}
+}
+
+// itemValue returns the value a keyed job has taken and its item, if the job has got one
+func itemValue(val interface{}) (interface{}, *item) {
+	if env, ok := val.(*item); ok {
+		return env.value, env
+	}
+	return val, nil
+}
+
+// itemOutput is what a keyed job sends for a value made from the items,
+// the value itself if the job has got plain values
+func itemOutput(value interface{}, from ...*item) interface{} {
+	var srcs []*item
+	for _, src := range from {
+		if src != nil {
+			srcs = append(srcs, src)
+		}
+	}
+	if len(srcs) == 0 {
+		return value
+	}
+	return itemResult{from: srcs, value: value}
+}
+
+var errAborted = errors.New("pipeline aborted")
+
+// ItemFunc processes a single item in a Map stage
+type ItemFunc func(data interface{}) (interface{}, error)
+
+type stageRun struct {
+	j       job
+	fn      ItemFunc
+	workers int
+	retry   *RetryPolicy
+	batch   *batchConfig
+	unbatch bool
+
+	st         *stageStats
+	policy     OverflowPolicy
+	ins        []chan *item
+	outs       []chan *item
+	deadLetter func(DeadLetter)
+	checkpoint *Checkpoint
+	tracer     Tracer
+	log        Logger
+	abort      *abortSignal
+	feeders    []*feeder
+	// the job gets items instead of values, see keyed
+	keyed bool
+
+	// numbers items of a source stage
+	nextSeq uint64
+	// trace IDs are unique among all sources of the pipeline
+	lastTrace *uint64
+
+	mu      sync.Mutex
+	taken   *item
+	takenAt time.Time
+}
+
+func (r *stageRun) source() bool {
+	return len(r.ins) == 0
+}
+
+func (r *stageRun) sink() bool {
+	return len(r.outs) == 0
+}
+
+// startFeeders passes items from all upstream stages into deliver,
+// which is closed when all upstream stages are over
+func (r *stageRun) startFeeders(deliver chan interface{}, unwrap bool, jobDone <-chan struct{}) *sync.WaitGroup {
+	feeding := &sync.WaitGroup{}
+	for _, in := range r.ins {
+		f := &feeder{probe: make(chan struct{}), exited: make(chan struct{})}
+		r.feeders = append(r.feeders, f)
+
+		feeding.Add(1)
+		go func(in chan *item) {
+			defer feeding.Done()
+			defer close(f.exited)
+			r.feed(f, in, deliver, unwrap, jobDone)
+		}(in)
+	}
+	go func() {
+		feeding.Wait()
+		close(deliver)
+	}()
+	return feeding
+}
+
+// run wraps the job with forwarding goroutines on both sides,
+// so we can see when items come in and out without touching the job itself.
+// Keyed jobs tell which inputs an output comes from, outputs of other jobs
+// are matched with inputs in FIFO order.
+func (r *stageRun) run() error {
+
+	r.keyed = isKeyed(r.j)
+	var jobIn chan interface{}
+	jobDone := make(chan struct{})
+	feeding := &sync.WaitGroup{}
+
+	// Sources have no input, as the first job always had
+	if !r.source() {
+		jobIn = make(chan interface{})
+		feeding = r.startFeeders(jobIn, true, jobDone)
+	}
+
+	// A job must not leave goroutines writing to out when it returns or panics,
+	// jobs with per-item goroutines make sure of it with itemGroup.Join
+	jobOut := make(chan interface{})
+	jobFinished := make(chan struct{})
+	var jobErr error
+	go func() {
+		defer close(jobFinished)
+		jobErr = r.runJob(jobIn, jobOut)
+	}()
+
+	var err error
+	for finished := false; !finished; {
+		select {
+		case val := <-jobOut:
+			if err != nil || r.abort.fired() {
+				// Let the job finish, nobody needs its results anymore
+				continue
+			}
+
+			env := &item{seq: noSeq, value: val}
+			if res, ok := val.(itemResult); ok {
+				env.value = res.value
+				env.join(res.from)
+				now := time.Now()
+				for _, from := range r.st.emittedFrom(res.from) {
+					r.span(from.env, from.at, now, nil)
+					r.log.Log(LevelDebug, "item processed", r.itemFields(from.env, now.Sub(from.at))...)
+				}
+			} else {
+				if r.source() {
+					env.seq = r.nextSeq
+					r.nextSeq++
+					if r.checkpoint != nil && r.checkpoint.Done(env.seq) {
+						continue
+					}
+					env.trace = atomic.AddUint64(r.lastTrace, 1)
+					now := time.Now()
+					r.span(env, now, now, nil)
+				}
+				if from, ok := r.st.emitted(); ok {
+					env.from(from.env)
+					now := time.Now()
+					r.span(from.env, from.at, now, nil)
+					r.log.Log(LevelDebug, "item processed", r.itemFields(from.env, now.Sub(from.at))...)
+				}
+			}
+
+			if err = r.send(env); err != nil {
+				r.abort.fire()
+			}
+		case <-jobFinished:
+			finished = true
+		}
+	}
+
+	if jobErr != nil {
+		// Downstream must not take the closed output for the end of the input
+		r.abort.fire()
+	}
+	close(jobOut)
+
+	// Items the job has taken without a result, e.g. the ones it has combined
+	var leftErr error
+	if r.abort.fired() {
+		leftErr = errAborted
+	}
+	now := time.Now()
+	for _, p := range r.st.takePending() {
+		r.span(p.env, p.at, now, leftErr)
+	}
+
+	close(jobDone)
+	for _, out := range r.outs {
+		close(out)
+	}
+	feeding.Wait()
+	r.st.finish()
+
+	if err == nil {
+		err = jobErr
+	}
+	return err
+}
+
+// runJob calls the job and recovers its panics. With a dead letter sink the failed items
+// of a job which uses itemGroup are sent there and the job is started again to process
+// the rest of the input. Any other job may hold items it has taken, so it fails the pipeline.
+func (r *stageRun) runJob(in, out chan interface{}) error {
+	for {
+		perrs, perItem := invoke(r.j, in, out)
+		if len(perrs) == 0 {
+			// Sequential sink has processed everything it took
+			r.sinkTook(nil)
+			return nil
+		}
+
+		restart := r.deadLetter != nil && perItem
+		r.syncFeeders()
+		for _, perr := range perrs {
+			if perr.Item == nil {
+				perr.Item = r.st.lastItem()
+			}
+			r.st.failed()
+			r.log.Log(LevelError, "stage panicked", F("stage", r.st.name), F("item", perr.Item), F("error", perr))
+
+			if r.sink() {
+				r.sinkFailed(perr, restart)
+			} else if p, ok := r.st.forget(perr.Item, perr.src); ok {
+				r.span(p.env, p.at, time.Now(), perr)
+			}
+		}
+
+		if !restart {
+			return perrs[0]
+		}
+
+		for _, perr := range perrs {
+			r.deadLetter(DeadLetter{
+				Stage: r.st.index,
+				Name:  r.st.name,
+				Item:  perr.Item,
+				Err:   perr,
+			})
+		}
+		// The job has finished its items or sent them to the dead letter sink
+		r.sinkTook(nil)
+
+		// A source would start all over again
+		if in == nil || r.abort.fired() {
+			return nil
+		}
+	}
+}
+
+// runMap calls the stage function for every item in a pool of workers,
+// unlike jobs it knows exactly which item every result comes from
+func (r *stageRun) runMap() error {
+
+	work := make(chan interface{})
+	feeding := r.startFeeders(work, false, nil)
+
+	workers := r.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	mu := &sync.Mutex{}
+	var err error
+	fail := func(e error) {
+		mu.Lock()
+		if err == nil {
+			err = e
+		}
+		mu.Unlock()
+		r.abort.fire()
+	}
+
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for val := range work {
+				env := val.(*item)
+				if r.abort.fired() {
+					continue
+				}
+
+				start := time.Now()
+				res, ferr := r.call(env.value)
+				end := time.Now()
+				r.st.processed(end.Sub(start), ferr == nil)
+				if r.abort.fired() {
+					// Some stage has failed while we were at it
+					continue
+				}
+				r.span(env, start, end, ferr)
+				if ferr != nil {
+					r.log.Log(LevelWarn, "item failed", append(r.itemFields(env, end.Sub(start)), F("error", ferr))...)
+				} else {
+					r.log.Log(LevelDebug, "item processed", r.itemFields(env, end.Sub(start))...)
+				}
+
+				if ferr != nil {
+					if r.deadLetter == nil {
+						fail(ferr)
+						continue
+					}
+					r.deadLetter(DeadLetter{
+						Stage: r.st.index,
+						Name:  r.st.name,
+						Item:  env.value,
+						Err:   ferr,
+					})
+				}
+
+				if r.sink() || ferr != nil {
+					r.markDone(env)
+					continue
+				}
+				result := &item{value: res}
+				result.from(env)
+				if serr := r.send(result); serr != nil {
+					fail(serr)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	for _, out := range r.outs {
+		close(out)
+	}
+	feeding.Wait()
+	r.st.finish()
+
+	return err
+}
+
+// callItem calls fn and turns its panic into an error
+func callItem(fn ItemFunc, data interface{}) (res interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Value: r, Item: data, Stack: debug.Stack()}
+		}
+	}()
+	return fn(data)
+}
+
+// send puts the item to all downstream stages
+func (r *stageRun) send(env *item) error {
+	for _, out := range r.outs {
+		start := time.Now()
+		dropped, err := push(out, env, r.policy)
+		r.st.sent(time.Since(start), len(out), dropped)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sinkTook tells the checkpoint and the tracer about items processed by a sink job. Jobs are assumed
+// to process items one by one: when a sink takes the next item, the previous one is done.
+// nil means that the job has processed everything it took.
+func (r *stageRun) sinkTook(env *item) {
+	if !r.sink() {
+		return
+	}
+
+	now := time.Now()
+	r.mu.Lock()
+	prev, prevAt := r.taken, r.takenAt
+	r.taken, r.takenAt = env, now
+	r.mu.Unlock()
+
+	if prev != nil {
+		r.markDone(prev)
+		r.span(prev, prevAt, now, nil)
+	}
+}
+
+// sinkFailed ends the span of the item a sink job has panicked on,
+// the item is done only if it goes to the dead letter sink
+func (r *stageRun) sinkFailed(err error, dead bool) {
+	r.mu.Lock()
+	prev, prevAt := r.taken, r.takenAt
+	r.taken = nil
+	r.mu.Unlock()
+
+	if prev == nil {
+		return
+	}
+	if dead {
+		r.markDone(prev)
+	}
+	r.span(prev, prevAt, time.Now(), err)
+}
+
+func (r *stageRun) markDone(env *item) {
+	if r.checkpoint == nil {
+		return
+	}
+	if env.seq != noSeq {
+		r.checkpoint.markDone(env.seq)
+	}
+	for _, seq := range env.seqs {
+		r.checkpoint.markDone(seq)
+	}
+}
+
+// feeder passes items from one upstream stage to the job
+type feeder struct {
+	probe  chan struct{}
+	exited chan struct{}
+}
+
+func (r *stageRun) feed(f *feeder, in <-chan *item, deliver chan<- interface{}, unwrap bool, jobDone <-chan struct{}) {
+	for {
+		start := time.Now()
+		var env *item
+		ok, received := false, false
+		for !received {
+			select {
+			case env, ok = <-in:
+				received = true
+			case <-f.probe:
+			}
+		}
+		r.st.waited(time.Since(start))
+		if !ok {
+			return
+		}
+
+		var val interface{} = env
+		if unwrap && !r.keyed {
+			val = env.value
+		}
+
+		for sent := false; !sent; {
+			select {
+			case deliver <- val:
+				r.st.received(env, unwrap && !r.sink())
+				if unwrap {
+					r.sinkTook(env)
+				}
+				sent = true
+			case <-f.probe:
+				continue
+			case <-jobDone:
+			case <-r.abort.done:
+			}
+
+			if !sent {
+				// Job has returned without reading everything or the pipeline is aborted,
+				// drain the rest so upstream stages don't get stuck
+				for range in {
+				}
+				return
+			}
+		}
+	}
+}
+
+// syncFeeders waits until every feeder has recorded the item it has handed to the job,
+// a feeder takes the probe only when it is waiting on a channel
+func (r *stageRun) syncFeeders() {
+	for _, f := range r.feeders {
+		select {
+		case f.probe <- struct{}{}:
+		case <-f.exited:
+		}
+	}
+}
+
+type abortSignal struct {
+	once *sync.Once
+	done chan struct{}
+}
+
+func newAbortSignal() *abortSignal {
+	return &abortSignal{once: &sync.Once{}, done: make(chan struct{})}
+}
+
+func (a *abortSignal) fire() {
+	a.once.Do(func() { close(a.done) })
+}
+
+func (a *abortSignal) fired() bool {
+	select {
+	case <-a.done:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Span is the time an item has spent in a stage. Every item coming out of a source
+// gets a trace ID, results made from it keep the ID, so all spans of an item
+// show its path through the pipeline.
+//
+// Map stages and keyed jobs, like SingleHash and MultiHash, know which item every result
+// comes from. Like latency, spans of other jobs match inputs with outputs in FIFO order,
+// which is right only for jobs which keep the order of items. Items taken by a job
+// without a result end when the job is over.
+type Span struct {
+	Trace uint64    `json:"trace"`
+	Stage int       `json:"stage"`
+	Name  string    `json:"name"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Error string    `json:"error,omitempty"`
+}
+
+// Tracer receives spans when stages are done with items, it is called from stage goroutines
+type Tracer interface {
+	Span(s Span)
+}
+
+type TracerFunc func(s Span)
+
+func (f TracerFunc) Span(s Span) {
+	f(s)
+}
+
+// WithTracer records spans of all items
+func WithTracer(t Tracer) PipelineOption {
+	return func(p *Pipeline) {
+		p.tracer = t
+	}
+}
+
+// JSONTracer writes spans as JSON lines
+type JSONTracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	err error
+}
+
+func NewJSONTracer(w io.Writer) *JSONTracer {
+	return &JSONTracer{enc: json.NewEncoder(w)}
+}
+
+func (t *JSONTracer) Span(s Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err == nil {
+		t.err = t.enc.Encode(s)
+	}
+}
+
+// Err returns the first write error, spans after it are not written
+func (t *JSONTracer) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// ReadTraces reads spans written by JSONTracer and groups them by trace ID,
+// spans of every trace are sorted by start time
+func ReadTraces(r io.Reader) (map[uint64][]Span, error) {
+	traces := make(map[uint64][]Span)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var s Span
+		if err := json.Unmarshal(scanner.Bytes(), &s); err != nil {
+			return nil, err
+		}
+		traces[s.Trace] = append(traces[s.Trace], s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, spans := range traces {
+		sort.SliceStable(spans, func(i, j int) bool {
+			return spans[i].Start.Before(spans[j].Start)
+		})
+	}
+	return traces, nil
+}
+
+// span records the time env has spent in the stage, a batch has a span for every element
+func (r *stageRun) span(env *item, start, end time.Time, err error) {
+	if r.tracer == nil {
+		return
+	}
+
+	s := Span{Stage: r.st.index, Name: r.st.name, Start: start, End: end}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	if env.trace != 0 {
+		s.Trace = env.trace
+		r.tracer.Span(s)
+	}
+	for _, trace := range env.traces {
+		s.Trace = trace
+		r.tracer.Span(s)
+	}
+}
+
+// sameValue compares items which are not always comparable, like batches
+func sameValue(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	t := reflect.TypeOf(a)
+	if t != reflect.TypeOf(b) || !t.Comparable() {
+		return false
+	}
+	return a == b
+}
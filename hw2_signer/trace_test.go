@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stagesOf returns stage indexes of the spans
+func stagesOf(spans []Span) []int {
+	var stages []int
+	for _, s := range spans {
+		stages = append(stages, s.Stage)
+	}
+	return stages
+}
+
+func hasPrefix(stages, prefix []int) bool {
+	if len(stages) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if stages[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// signerDelay makes earlier items take longer, so they come out of SingleHash in reverse
+func signerDelay(data int) time.Duration {
+	return time.Duration(3-data) * 20 * time.Millisecond
+}
+
+// checkSignerTraces checks paths of 3 items through source, SingleHash, MultiHash,
+// CombineResults and the sink
+func checkSignerTraces(t *testing.T, buf *syncBuffer) {
+	t.Helper()
+	traces, err := ReadTraces(bytes.NewBufferString(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 3 {
+		t.Fatalf("expected 3 traces, got %d", len(traces))
+	}
+
+	for id, spans := range traces {
+		// Combined result comes from all the items
+		stages := stagesOf(spans)
+		if !hasPrefix(stages, []int{0, 1, 2, 3, 4}) || len(stages) != 5 {
+			t.Errorf("trace %d: unexpected path %v", id, stages)
+		}
+		// Source numbers items from 1 in the order they come
+		if d := signerDelay(int(id) - 1); len(spans) > 1 && spans[1].End.Sub(spans[1].Start) < d {
+			t.Errorf("trace %d: span %+v is shorter than the item delay %v", id, spans[1], d)
+		}
+		for i, s := range spans {
+			if s.End.Before(s.Start) || s.Error != "" {
+				t.Errorf("trace %d: bad span %+v", id, s)
+			}
+			// A stage gets the item only after the previous one is done with it
+			if i > 0 && s.Start.Before(spans[i-1].End) {
+				t.Errorf("trace %d: span %+v starts before %+v ends", id, s, spans[i-1])
+			}
+		}
+	}
+}
+
+func TestTraceSigner(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	single := SingleHashFunc(defaultScheme)
+	g := NewGraph().
+		Stage("source", countTo(3)).
+		Map("single", func(data interface{}) (interface{}, error) {
+			time.Sleep(signerDelay(data.(int)))
+			return single(data)
+		}, 3).
+		Map("multi", MultiHashFunc(defaultScheme), 3).
+		Stage("combine", CombineResults).
+		Stage("sink", func(in, out chan interface{}) {
+			for range in {
+			}
+		}).
+		Chain("source", "single", "multi", "combine", "sink")
+
+	buf := &syncBuffer{}
+	tracer := NewJSONTracer(buf)
+	err := NewPipeline(WithTracer(tracer)).Run(g)
+	if err != nil || tracer.Err() != nil {
+		t.Fatal(err, tracer.Err())
+	}
+
+	checkSignerTraces(t, buf)
+}
+
+func TestTraceSignerJobs(t *testing.T) {
+	_, restore := fastSigners()
+	defer restore()
+
+	// SingleHash and MultiHash jobs reorder items, they tell which item a result comes from
+	scheme := *defaultScheme
+	scheme.Outer = SignerFunc(func(data string) string {
+		if n, err := strconv.Atoi(data); err == nil {
+			time.Sleep(signerDelay(n))
+		}
+		return signCrc32(data)
+	})
+
+	buf := &syncBuffer{}
+	tracer := NewJSONTracer(buf)
+	err := NewPipeline(WithTracer(tracer)).Execute(
+		countTo(3),
+		NewSingleHash(&scheme),
+		NewMultiHash(&scheme),
+		CombineResults,
+		func(in, out chan interface{}) {
+			for range in {
+			}
+		},
+	)
+	if err != nil || tracer.Err() != nil {
+		t.Fatal(err, tracer.Err())
+	}
+	checkSignerTraces(t, buf)
+}
+
+func TestTraceErrors(t *testing.T) {
+	mu := &sync.Mutex{}
+	traces := make(map[uint64][]Span)
+	tracer := TracerFunc(func(s Span) {
+		mu.Lock()
+		traces[s.Trace] = append(traces[s.Trace], s)
+		mu.Unlock()
+	})
+
+	g := NewGraph().
+		Stage("source", countTo(4)).
+		Map("check", func(data interface{}) (interface{}, error) {
+			if data == 2 {
+				return nil, errors.New("bad item")
+			}
+			return data, nil
+		}, 2).
+		Stage("sink", func(in, out chan interface{}) {
+			for range in {
+			}
+		}).
+		Chain("source", "check", "sink")
+
+	err := NewPipeline(WithTracer(tracer), WithDeadLetter(func(DeadLetter) {})).Run(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Source numbers items from 1 in the order they come
+	for id := uint64(1); id <= 4; id++ {
+		spans := traces[id]
+		if id == 3 {
+			if len(spans) != 2 || spans[1].Name != "check" || spans[1].Error != "bad item" {
+				t.Errorf("failed item: unexpected spans %+v", spans)
+			}
+			continue
+		}
+		if stages := stagesOf(spans); len(stages) != 3 {
+			t.Errorf("trace %d: unexpected path %v", id, stages)
+		}
+	}
+}
+
+func TestTraceBatch(t *testing.T) {
+	mu := &sync.Mutex{}
+	paths := make(map[uint64][]int)
+	runBatches(t, countTo(10), 4, 0, WithTracer(TracerFunc(func(s Span) {
+		mu.Lock()
+		paths[s.Trace] = append(paths[s.Trace], s.Stage)
+		mu.Unlock()
+	})))
+
+	if len(paths) != 10 {
+		t.Fatalf("expected 10 traces, got %d", len(paths))
+	}
+	for id, stages := range paths {
+		if len(stages) != 5 {
+			t.Errorf("trace %d: unexpected path %v", id, stages)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Window tells CombineWindow when to emit a partial result,
+// the window is closed by whatever condition is met first.
+// Zero fields are not used.
+type Window struct {
+	// Count closes the window after that many items
+	Count int
+	// Every closes the window periodically, counting from the first item of the window
+	Every time.Duration
+	// Gap closes the window when no items come for that long
+	Gap time.Duration
+}
+
+// CombineWindow works like CombineResults, but emits results of every window
+// as the stream flows instead of waiting for the end of input.
+// The last window is emitted when the input is over, empty windows are not emitted.
+// It is a keyed job: a result of a window comes from all the items of the window.
+func CombineWindow(w Window) job {
+	return keyed(func(in, out chan interface{}) {
+
+		var results []string
+		var from []*item
+		var every, gap <-chan time.Time
+		var everyTimer, gapTimer *time.Timer
+
+		flush := func() {
+			if len(results) > 0 {
+				out <- itemOutput(combine(results), from...)
+				results, from = nil, nil
+			}
+			if everyTimer != nil {
+				everyTimer.Stop()
+				everyTimer, every = nil, nil
+			}
+		}
+
+		for {
+			select {
+			case val, ok := <-in:
+				if !ok {
+					flush()
+					return
+				}
+
+				data, src := itemValue(val)
+				results = append(results, data.(string))
+				from = append(from, src)
+
+				if w.Every > 0 && everyTimer == nil {
+					everyTimer = time.NewTimer(w.Every)
+					every = everyTimer.C
+				}
+				if w.Gap > 0 {
+					if gapTimer != nil {
+						gapTimer.Stop()
+					}
+					gapTimer = time.NewTimer(w.Gap)
+					gap = gapTimer.C
+				}
+				if w.Count > 0 && len(results) >= w.Count {
+					flush()
+				}
+
+			case <-every:
+				everyTimer, every = nil, nil
+				flush()
+
+			case <-gap:
+				gapTimer, gap = nil, nil
+				flush()
+			}
+		}
+	})
+}
+
+// combine sorts results and joins them with "_"
+func combine(results []string) string {
+	sort.Strings(results)
+	return strings.Join(results, "_")
+}
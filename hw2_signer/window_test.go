@@ -0,0 +1,112 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// combineWindows sends items with pauses between them, a zero item stands for a pause
+func combineWindows(w Window, pause time.Duration, items ...int) []string {
+	var got []string
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			for _, item := range items {
+				if item == 0 {
+					time.Sleep(pause)
+					continue
+				}
+				out <- strconv.Itoa(item)
+			}
+		}),
+		CombineWindow(w),
+		job(func(in, out chan interface{}) {
+			for val := range in {
+				got = append(got, val.(string))
+			}
+		}),
+	)
+	return got
+}
+
+func TestCombineWindowCount(t *testing.T) {
+	got := combineWindows(Window{Count: 3}, 0, 3, 1, 2, 6, 5, 4, 7)
+	if strings.Join(got, " ") != "1_2_3 4_5_6 7" {
+		t.Errorf("unexpected windows %v", got)
+	}
+}
+
+func TestCombineWindowGap(t *testing.T) {
+	got := combineWindows(Window{Gap: 30 * time.Millisecond}, 100*time.Millisecond, 2, 1, 0, 3, 0, 0, 5, 4)
+	if strings.Join(got, " ") != "1_2 3 4_5" {
+		t.Errorf("unexpected windows %v", got)
+	}
+}
+
+func TestCombineWindowEvery(t *testing.T) {
+	got := combineWindows(Window{Every: 50 * time.Millisecond}, 200*time.Millisecond, 1, 2, 0, 3, 4, 0)
+	if strings.Join(got, " ") != "1_2 3_4" {
+		t.Errorf("unexpected windows %v", got)
+	}
+}
+
+func TestCombineWindowEmitsBeforeInputEnds(t *testing.T) {
+	var firstAt time.Duration
+	start := time.Now()
+
+	ExecutePipeline(
+		job(func(in, out chan interface{}) {
+			out <- "a"
+			time.Sleep(200 * time.Millisecond)
+		}),
+		CombineWindow(Window{Count: 10, Every: 20 * time.Millisecond}),
+		job(func(in, out chan interface{}) {
+			<-in
+			firstAt = time.Since(start)
+		}),
+	)
+
+	if firstAt > 100*time.Millisecond {
+		t.Errorf("first window came after %s, should not wait for the end of input", firstAt)
+	}
+}
+
+func TestCombineWindowForgetsItems(t *testing.T) {
+	p := NewPipeline()
+	pending, windows := 0, 0
+	err := p.Execute(
+		countTo(10000),
+		func(in, out chan interface{}) {
+			for val := range in {
+				out <- strconv.Itoa(val.(int))
+			}
+		},
+		CombineWindow(Window{Count: 100}),
+		func(in, out chan interface{}) {
+			for range in {
+				windows++
+				st := p.stages[2]
+				st.mu.Lock()
+				if len(st.pending) > pending {
+					pending = len(st.pending)
+				}
+				st.mu.Unlock()
+			}
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if windows != 100 {
+		t.Errorf("expected 100 windows, got %d", windows)
+	}
+	// Items of combined windows are done, only the items of the next windows wait for them:
+	// the window being sent and the one the job collects meanwhile
+	if pending > 2*100+1 {
+		t.Errorf("stage remembers %d items, expected at most two windows", pending)
+	}
+	if st := p.Snapshot()[2]; st.In != 10000 || st.Out != 100 {
+		t.Errorf("unexpected counts %d in, %d out", st.In, st.Out)
+	}
+}
@@ -18,11 +18,31 @@ func SlowSearch(out io.Writer) {
 	if err != nil {
 		panic(err)
 	}
+	defer file.Close()
 
-	fileContents, err := ioutil.ReadAll(file)
+	if err := slowSearch(out, file, false); err != nil {
+		panic(err)
+	}
+}
+
+// SlowSearchLenient is SlowSearch which skips lines it can't parse and reports them at the end
+func SlowSearchLenient(out io.Writer) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		panic(err)
 	}
+	defer file.Close()
+
+	if err := slowSearch(out, file, true); err != nil {
+		panic(err)
+	}
+}
+
+func slowSearch(out io.Writer, in io.Reader, lenient bool) error {
+	fileContents, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
 
 	r := regexp.MustCompile("@")
 	seenBrowsers := []string{}
@@ -31,13 +51,26 @@ func SlowSearch(out io.Writer) {
 
 	lines := strings.Split(string(fileContents), "\n")
 
+	var malformed *Malformed
+	if lenient {
+		malformed = &Malformed{}
+	}
+
 	users := make([]map[string]interface{}, 0)
-	for _, line := range lines {
+	for i, line := range lines {
+		// piped input usually ends with a newline
+		if line == "" && i == len(lines)-1 && i > 0 {
+			break
+		}
 		user := make(map[string]interface{})
 		// fmt.Printf("%v %v\n", err, line)
 		err := json.Unmarshal([]byte(line), &user)
-		if err != nil {
-			panic(err)
+		if err != nil && lenient {
+			// a user without browsers keeps numbers of the next users
+			malformed.add(i + 1)
+			user = nil
+		} else if err != nil {
+			return &LineError{Line: i + 1, Err: err}
 		}
 		users = append(users, user)
 	}
@@ -108,4 +141,8 @@ func SlowSearch(out io.Writer) {
 
 	fmt.Fprintln(out, "found users:\n"+foundUsers)
 	fmt.Fprintln(out, "Total unique browsers", len(seenBrowsers))
+	if lenient {
+		fmt.Fprintln(out, malformed)
+	}
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import jlexer "github.com/mailru/easyjson/jlexer"
+
+// decodeUser is the generated easyjson decoder of User which only reads fields of the mask,
+// so the search doesn't spend allocations on fields nobody looks at. It lives apart from
+// the generated code in fast.go, which easyjson overwrites.
+func decodeUser(in *jlexer.Lexer, out *User, fields fieldMask) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "browsers":
+			if in.IsNull() {
+				in.Skip()
+				out.Browsers = nil
+			} else {
+				in.Delim('[')
+				if out.Browsers == nil {
+					if !in.IsDelim(']') {
+						out.Browsers = make([]string, 0, 4)
+					} else {
+						out.Browsers = []string{}
+					}
+				} else {
+					out.Browsers = (out.Browsers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v1 string
+					v1 = string(in.String())
+					out.Browsers = append(out.Browsers, v1)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "name":
+			out.Name = string(in.String())
+		case "email":
+			out.Email = string(in.String())
+		case "company":
+			out.Company = decodeField(in, fields, FieldCompany)
+		case "country":
+			out.Country = decodeField(in, fields, FieldCountry)
+		case "job":
+			out.Job = decodeField(in, fields, FieldJob)
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+
+func decodeField(in *jlexer.Lexer, fields fieldMask, f Field) string {
+	if fields&f.mask() == 0 {
+		in.Skip()
+		return ""
+	}
+	return string(in.String())
+}
@@ -5,7 +5,6 @@ import (
 	json "encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"strconv"
 	"strings"
 
@@ -18,69 +17,189 @@ import (
 
 type User struct {
 	Browsers []string `json:"browsers"`
-	Name     string   `json:"name"`
+	Company  string   `json:"company"`
+	Country  string   `json:"country"`
 	Email    string   `json:"email"`
+	Job      string   `json:"job"`
+	Name     string   `json:"name"`
 }
 
-func FastSearch(out io.Writer) {
-	file, err := os.Open(filePath)
+// androidAndMSIE is what FastSearch looks for
+var androidAndMSIE = MustCompile(And(
+	Contains(FieldBrowsers, "Android"),
+	Contains(FieldBrowsers, "MSIE"),
+))
 
-	if err != nil {
+// FastSearch doesn't read the last line if it has no newline, like its first version,
+// the other searches read it
+func FastSearch(out io.Writer) {
+	if err := SearchFile(out, filePath, withoutUnterminated()); err != nil {
 		panic(err)
 	}
+}
 
-	defer file.Close()
+// FastSearchQuery prints users matching the query and the number of unique browsers
+// which satisfy browser predicates of the query
+func FastSearchQuery(out io.Writer, q *Query) {
+	if err := SearchFile(out, filePath, WithQuery(q)); err != nil {
+		panic(err)
+	}
+}
 
-	reader := bufio.NewReader(file)
+// FastSearchLenient is FastSearch which skips lines it can't parse and reports them at the end
+func FastSearchLenient(out io.Writer) {
+	if err := SearchFile(out, filePath, WithLenient()); err != nil {
+		panic(err)
+	}
+}
 
-	fmt.Fprintln(out, "found users:")
+func fastSearch(out io.Writer, r io.Reader, o *searchOptions) error {
+	w := o.newResultWriter(out)
+	if err := w.begin(); err != nil {
+		return err
+	}
 
+	var writeErr error
 	seenBrowsers := make(map[string]bool)
+	malformed := o.newMalformed()
+	_, err := scanUsers(r, o, seenBrowsers, malformed, func(i int, user *User) {
+		if writeErr == nil {
+			writeErr = w.user(i, user)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
 
-	var user User
-	var isAndroid, isMSIE bool
+	o.reportMalformed(malformed)
+	return w.end(len(seenBrowsers), malformed)
+}
 
-	for i := 0; ; i++ {
+// LineError is an error in a line of the input, lines are numbered from 1
+type LineError struct {
+	Line int
+	Err  error
+}
 
-		line, err := reader.ReadBytes('\n')
-		if err == io.EOF {
-			break
-		}
+func (e *LineError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
 
-		err = user.UnmarshalJSON(line)
-		if err != nil {
-			panic(err)
-		}
+func (e *LineError) Unwrap() error {
+	return e.Err
+}
+
+// maxMalformedLines is how many numbers of malformed lines are kept, the rest are only counted
+const maxMalformedLines = 100
 
-		isAndroid = false
-		isMSIE = false
+// Malformed is the report of lines skipped in the lenient mode
+type Malformed struct {
+	Count int `json:"count"`
+	// Lines are numbers of the first malformed lines counting from 1, like LineError does
+	Lines []int `json:"lines,omitempty"`
+}
 
-		for _, browser := range user.Browsers {
+func (m *Malformed) add(line int) {
+	m.Count++
+	if len(m.Lines) < maxMalformedLines {
+		m.Lines = append(m.Lines, line)
+	}
+}
 
-			if strings.Contains(browser, "Android") {
-				isAndroid = true
-				seenBrowsers[browser] = true
-			}
+// merge adds lines of a report of the input part which starts after first lines
+func (m *Malformed) merge(other *Malformed, first int) {
+	for _, line := range other.Lines {
+		m.add(first + line)
+	}
+	m.Count += other.Count - len(other.Lines)
+}
 
-			if strings.Contains(browser, "MSIE") {
-				isMSIE = true
-				seenBrowsers[browser] = true
+func (m *Malformed) String() string {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Malformed lines %d", m.Count)
+	for i, line := range m.Lines {
+		if i == 0 {
+			b.WriteString(": ")
+		} else {
+			b.WriteString(", ")
+		}
+		b.WriteString(strconv.Itoa(line))
+	}
+	if more := m.Count - len(m.Lines); more > 0 {
+		fmt.Fprintf(b, " and %d more", more)
+	}
+	return b.String()
+}
+
+// scanUsers reads users from r line by line and calls found for users matching the query,
+// i is the number of the line in r counting from 0. It returns the number of lines read.
+// Only fields the options need are extracted, and only users passed to found are decoded.
+// If malformed is not nil, lines which can't be parsed are skipped and added to malformed.
+func scanUsers(r io.Reader, o *searchOptions, seenBrowsers map[string]bool, malformed *Malformed, found func(i int, user *User)) (int, error) {
+	scanner := &userScanner{fields: o.decodeFields()}
+	q := o.query
+	var user User
+
+	return scanLines(r, !o.skipUnterminated, func(i int, line []byte) error {
+		if err := scanner.scan(line); err != nil {
+			if malformed != nil {
+				malformed.add(i + 1)
+				return nil
 			}
+			return &LineError{Line: i + 1, Err: err}
 		}
 
-		if isAndroid && isMSIE {
-			email := strings.Replace(user.Email, "@", " [at] ", 1)
-			fmt.Fprintln(out, "["+strconv.Itoa(i)+"] "+user.Name+" <"+email+">")
+		if q.matchScanned(scanner, seenBrowsers) {
+			scanner.user(&user)
+			found(i, &user)
 		}
+		return nil
+	})
+}
 
-	}
+// scanLines calls fn for every line of r until it returns an error, i is the number of the line
+// counting from 0. The line is valid only until fn returns. It returns the number of lines read.
+// The last line without a newline may be half written and is read only if unterminated is true.
+func scanLines(r io.Reader, unterminated bool, fn func(i int, line []byte) error) (int, error) {
+	reader := bufio.NewReader(r)
+	var long []byte
 
-	// if err := reader.Err(); err != nil {
-	// 	log.Fatal(err)
-	// }
+	i := 0
+	for ; ; i++ {
+
+		// the line is in the reader buffer until the next read,
+		// lines longer than the buffer are collected in long
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			long = append(long[:0], line...)
+			for err == bufio.ErrBufferFull {
+				line, err = reader.ReadSlice('\n')
+				long = append(long, line...)
+			}
+			line = long
+		}
+		if err == io.EOF {
+			if unterminated && len(line) > 0 {
+				if err := fn(i, line); err != nil {
+					return i, err
+				}
+				i++
+			}
+			break
+		}
+		if err != nil {
+			return i, err
+		}
 
-	fmt.Fprintln(out, "\nTotal unique browsers", len(seenBrowsers))
+		if err := fn(i, line); err != nil {
+			return i, err
+		}
+	}
 
+	return i, nil
 }
 
 // suppress unused package warning
@@ -133,10 +252,16 @@ func easyjson3486653aDecodeGithubComMikaelLazarevGolangMipt11(in *jlexer.Lexer,
 				}
 				in.Delim(']')
 			}
-		case "name":
-			out.Name = string(in.String())
+		case "company":
+			out.Company = string(in.String())
+		case "country":
+			out.Country = string(in.String())
 		case "email":
 			out.Email = string(in.String())
+		case "job":
+			out.Job = string(in.String())
+		case "name":
+			out.Name = string(in.String())
 		default:
 			in.SkipRecursive()
 		}
@@ -168,15 +293,30 @@ func easyjson3486653aEncodeGithubComMikaelLazarevGolangMipt11(out *jwriter.Write
 		}
 	}
 	{
-		const prefix string = ",\"name\":"
+		const prefix string = ",\"company\":"
 		out.RawString(prefix)
-		out.String(string(in.Name))
+		out.String(string(in.Company))
+	}
+	{
+		const prefix string = ",\"country\":"
+		out.RawString(prefix)
+		out.String(string(in.Country))
 	}
 	{
 		const prefix string = ",\"email\":"
 		out.RawString(prefix)
 		out.String(string(in.Email))
 	}
+	{
+		const prefix string = ",\"job\":"
+		out.RawString(prefix)
+		out.String(string(in.Job))
+	}
+	{
+		const prefix string = ",\"name\":"
+		out.RawString(prefix)
+		out.String(string(in.Name))
+	}
 	out.RawByte('}')
 }
 
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// GeneratorConfig describes users made by Generate, the same seed makes the same users
+type GeneratorConfig struct {
+	Seed  int64
+	Users int
+	// Browsers is the number of browsers of every user
+	Browsers int
+	// Predicates are the shares of users Contains(Field, Value) finds
+	Predicates []GeneratedRate
+}
+
+// GeneratedRate makes Rate of users have Value in Field, which is the browsers, country, company or job.
+// Every browser predicate takes its own browser of a user, so they are independent and
+// about RateA*RateB users match both A and B. A user has one country, company and job,
+// so predicates on one of them exclude each other and their rates add up.
+// Other values are picked so that they don't contain the values of predicates on their field,
+// but a value with a predicate may contain the value of another one, like Android browsers have Safari.
+type GeneratedRate struct {
+	Field Field
+	Value string
+	Rate  float64
+}
+
+// DefaultGeneratorConfig makes users like in data/users.txt
+func DefaultGeneratorConfig(users int) GeneratorConfig {
+	return GeneratorConfig{
+		Seed:     1,
+		Users:    users,
+		Browsers: 4,
+		Predicates: []GeneratedRate{
+			{FieldBrowsers, "Android", 0.42},
+			{FieldBrowsers, "MSIE", 0.25},
+		},
+	}
+}
+
+func (c *GeneratorConfig) validate() error {
+	if c.Users < 0 {
+		return fmt.Errorf("negative number of users %d", c.Users)
+	}
+	browsers := 0
+	rates := make(map[Field]float64)
+	for _, p := range c.Predicates {
+		if p.Rate < 0 || p.Rate > 1 {
+			return fmt.Errorf("%s:%q: rate must be between 0 and 1, got %v", p.Field, p.Value, p.Rate)
+		}
+		if p.Value == "" {
+			return fmt.Errorf("%s: empty value", p.Field)
+		}
+		switch p.Field {
+		case FieldBrowsers:
+			browsers++
+		case FieldCountry, FieldCompany, FieldJob:
+			rates[p.Field] += p.Rate
+			if rates[p.Field] > 1 {
+				return fmt.Errorf("%s: rates add up to more than 1", p.Field)
+			}
+			if len(c.fieldValues(p.Field)) == 0 {
+				return fmt.Errorf("%s: every value contains one of the predicates", p.Field)
+			}
+		default:
+			return fmt.Errorf("%s: can't generate predicates on the field", p.Field)
+		}
+	}
+	if c.Browsers < browsers {
+		return fmt.Errorf("users need at least %d browsers for the predicates, got %d", browsers, c.Browsers)
+	}
+	if len(c.otherBrowsers()) == 0 {
+		return fmt.Errorf("every browser contains one of the predicates")
+	}
+	return nil
+}
+
+// containsPredicate tells if s has the value of a predicate on f other than skip
+func (c *GeneratorConfig) containsPredicate(f Field, s string, skip int) bool {
+	for i, p := range c.Predicates {
+		if i != skip && p.Field == f && strings.Contains(s, p.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// fieldValues are the values of f without the values of its predicates
+func (c *GeneratorConfig) fieldValues(f Field) []string {
+	var values []string
+	for _, v := range generatedValues[f] {
+		if !c.containsPredicate(f, v, -1) {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// otherBrowsers are the templates of browsers without the values of browser predicates
+func (c *GeneratorConfig) otherBrowsers() []string {
+	var templates []string
+	for _, t := range otherBrowsers {
+		if !c.containsPredicate(FieldBrowsers, t, -1) {
+			templates = append(templates, t)
+		}
+	}
+	return templates
+}
+
+// browserTemplates are the templates of the browser predicate i, others are made of the generic one
+func (c *GeneratorConfig) browserTemplates(i int) []string {
+	var templates []string
+	for _, t := range predicateBrowsers[c.Predicates[i].Value] {
+		if !c.containsPredicate(FieldBrowsers, t, i) {
+			templates = append(templates, t)
+		}
+	}
+	if len(templates) == 0 {
+		value := strings.Replace(c.Predicates[i].Value, "%", "%%", -1)
+		templates = []string{"Mozilla/5.0 (compatible; " + value + " %d.%d; %s; %s)"}
+	}
+	return templates
+}
+
+// Browser templates get random versions, so the number of unique browsers grows with the file.
+// Android ones have no MSIE, MSIE ones have no Android and the others have neither.
+var (
+	androidBrowsers = []string{
+		"Mozilla/5.0 (Linux; U; Android %d.%d; en-us; %s Build/%s) AppleWebKit/534.30 (KHTML, like Gecko) Version/4.0 Mobile Safari/534.30",
+		"Mozilla/5.0 (Linux; Android %d.%d; %s Build/%s) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/53.0.2785.97 Mobile Safari/537.36",
+		"Mozilla/5.0 (Android %d.%d; Mobile; %s; %s) Gecko/20100101 Firefox/41.0",
+	}
+	msieBrowsers = []string{
+		"Mozilla/4.0 (compatible; MSIE %d.%d; Windows NT 5.1; %s; %s)",
+		"Mozilla/5.0 (compatible; MSIE %d.%d; Windows NT 6.1; Trident/5.0; %s; %s)",
+		"Mozilla/4.0 (compatible; MSIE %d.%d; Windows CE; IEMobile 7.11) %s/%s",
+	}
+	otherBrowsers = []string{
+		"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/%d.%d.%d.%d Safari/537.36",
+		"Mozilla/5.0 (Windows NT 6.1; rv:%d.%d) Gecko/20100101 Firefox/%d.%d",
+		"Opera/9.80 (X11; Linux i686; U; ru) Presto/2.%d.%d Version/%d.%d",
+		"Mozilla/5.0 (iPad; CPU OS %d_%d like Mac OS X) AppleWebKit/600.1.4 (KHTML, like Gecko) Version/%d.%d Safari/600.1.4",
+		"SonyEricssonK%d%di/R1CB Browser/NetFront/3.3 Profile/MIDP-2.0 Configuration/CLDC-%d.%d",
+	}
+	devices   = []string{"GT-P7100", "HTC Sensation", "LG-D850", "SM-T230NU", "Nexus 5", "Z820", "Lumia 630", "SV1"}
+	builds    = []string{"IML74K", "MRA58K", "KOT49H", "HRI83", "LMY47D", "CUPCAKE", "NET CLR 1.1.4322"}
+	firsts    = []string{"Sharon", "Susan", "Joshua", "Anna", "Ivan", "Jonathan", "Maria", "Peter", "Olga", "Kevin"}
+	lasts     = []string{"Crawford", "Ellis", "Fisher", "Morris", "Petrov", "Lee", "Garcia", "Smirnova", "Brown", "Young"}
+	companies = []string{"Flashpoint", "Jatri", "Dabtype", "Muxo", "Topiczoom", "Voonix", "Yandex", "Skinix", "Zoomzone", "Quatz"}
+	countries = []string{"Dominican Republic", "Kenya", "Ecuador", "Russia", "Chile", "Japan", "Poland", "Canada", "Peru", "Egypt"}
+	jobs      = []string{"Programmer Analyst #{N}", "Web Developer #{N}", "Internal Auditor", "Senior Editor", "Nurse", "Geologist I", "VP Sales"}
+	domains   = []string{"edu", "info", "gov", "com", "net", "org", "ru"}
+
+	predicateBrowsers = map[string][]string{"Android": androidBrowsers, "MSIE": msieBrowsers}
+	generatedValues   = map[Field][]string{FieldCountry: countries, FieldCompany: companies, FieldJob: jobs}
+)
+
+// Generate writes users as lines of JSON in the schema of data/users.txt, every line ends with a newline
+func Generate(w io.Writer, c GeneratorConfig) error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	rnd := rand.New(rand.NewSource(c.Seed))
+	bw := bufio.NewWriter(w)
+	browsers := make([]string, c.Browsers)
+
+	others := make(map[Field][]string)
+	for f := range generatedValues {
+		others[f] = c.fieldValues(f)
+	}
+	otherTemplates := c.otherBrowsers()
+	templates := make([][]string, len(c.Predicates))
+	for i, p := range c.Predicates {
+		if p.Field == FieldBrowsers {
+			templates[i] = c.browserTemplates(i)
+		}
+	}
+
+	for i := 0; i < c.Users; i++ {
+		for j := range browsers {
+			browsers[j] = fmt.Sprintf(pick(rnd, otherTemplates), rnd.Intn(10), rnd.Intn(10), rnd.Intn(10), rnd.Intn(10))
+		}
+		// browser predicates take different places, so their rates hold together
+		places := rnd.Perm(c.Browsers)
+		for j, p := range c.Predicates {
+			if p.Field != FieldBrowsers {
+				continue
+			}
+			if rnd.Float64() < p.Rate {
+				browsers[places[0]] = deviceBrowser(rnd, templates[j])
+			}
+			places = places[1:]
+		}
+
+		first, last := pick(rnd, firsts), pick(rnd, lasts)
+		company := c.pickField(rnd, FieldCompany, others)
+
+		out := jwriter.Writer{}
+		out.RawString(`{"browsers":[`)
+		for j, browser := range browsers {
+			if j > 0 {
+				out.RawByte(',')
+			}
+			out.String(browser)
+		}
+		out.RawString(`],"company":`)
+		out.String(company)
+		out.RawString(`,"country":`)
+		out.String(c.pickField(rnd, FieldCountry, others))
+		out.RawString(`,"email":`)
+		out.String(first + last + strconv.Itoa(rnd.Intn(100)) + "@" + company + "." + pick(rnd, domains))
+		out.RawString(`,"job":`)
+		out.String(c.pickField(rnd, FieldJob, others))
+		out.RawString(`,"name":`)
+		out.String(first + " " + last)
+		out.RawString(`,"phone":`)
+		out.String(fmt.Sprintf("%03d-%02d-%02d", rnd.Intn(1000), rnd.Intn(100), rnd.Intn(100)))
+		out.RawString("}\n")
+
+		if _, err := out.DumpTo(bw); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// GenerateFile writes users made by Generate to the file at path
+func GenerateFile(path string, c GeneratorConfig) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := Generate(file, c); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func pick(rnd *rand.Rand, values []string) string {
+	return values[rnd.Intn(len(values))]
+}
+
+// pickField returns the value of a predicate on f with its rate or one of the other values
+func (c *GeneratorConfig) pickField(rnd *rand.Rand, f Field, others map[Field][]string) string {
+	if !c.hasPredicates(f) {
+		return pick(rnd, others[f])
+	}
+	x := rnd.Float64()
+	for _, p := range c.Predicates {
+		if p.Field != f {
+			continue
+		}
+		if x < p.Rate {
+			return p.Value
+		}
+		x -= p.Rate
+	}
+	return pick(rnd, others[f])
+}
+
+func (c *GeneratorConfig) hasPredicates(f Field) bool {
+	for _, p := range c.Predicates {
+		if p.Field == f {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceBrowser makes a browser of a template with the version and the device
+func deviceBrowser(rnd *rand.Rand, templates []string) string {
+	return fmt.Sprintf(pick(rnd, templates),
+		rnd.Intn(10), rnd.Intn(10),
+		pick(rnd, devices), pick(rnd, builds))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func generate(t testing.TB, c GeneratorConfig) []byte {
+	buf := new(bytes.Buffer)
+	if err := Generate(buf, c); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// benchUsers is the size of generated files for benchmarks, about 50 MB
+const benchUsers = 100000
+
+// generatedFile writes users made with the default config to a temporary file
+func generatedFile(b *testing.B, users int) (string, func()) {
+	dir, err := ioutil.TempDir("", "generated")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("users-%d.txt", users))
+	if err := GenerateFile(path, DefaultGeneratorConfig(users)); err != nil {
+		os.RemoveAll(dir)
+		b.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestGenerateDeterministic(t *testing.T) {
+	c := DefaultGeneratorConfig(100)
+	first, second := generate(t, c), generate(t, c)
+	if !bytes.Equal(first, second) {
+		t.Error("the same seed should make the same users")
+	}
+
+	c.Seed = 2
+	if bytes.Equal(first, generate(t, c)) {
+		t.Error("another seed should make other users")
+	}
+}
+
+func TestGenerateRates(t *testing.T) {
+	c := DefaultGeneratorConfig(20000)
+	c.Predicates = []GeneratedRate{
+		{FieldBrowsers, "Android", 0.3},
+		{FieldBrowsers, "MSIE", 0.6},
+		{FieldBrowsers, "Opera", 0.2},
+		{FieldBrowsers, "Netscape", 0.1},
+		{FieldCompany, "Acme", 0.2},
+		{FieldCompany, "Yandex", 0.1},
+		{FieldCountry, "Atlantis", 0.5},
+	}
+	data := generate(t, c)
+
+	for query, expected := range map[string]float64{
+		`browsers:"Android"`:                       0.3,
+		`browsers:"Android" AND browsers:"MSIE"`:   0.3 * 0.6,
+		`browsers:"Opera"`:                         0.2,
+		`browsers:"Netscape" AND browsers:"Opera"`: 0.1 * 0.2,
+		`company:"Acme"`:                           0.2,
+		// Yandex is one of the companies, the others don't have it
+		`company:"Yandex"`:                       0.1,
+		`country:"Atlantis" AND browsers:"MSIE"`: 0.5 * 0.6,
+		`company:"Acme" AND company:"Yandex"`:    0,
+	} {
+		report, err := Aggregate(bytes.NewReader(data), WithTop(0), WithFilter(mustParseQuery(t, query)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rate := float64(report.Users) / float64(c.Users); math.Abs(rate-expected) > 0.02 {
+			t.Errorf("%s: expected rate %v, got %v", query, expected, rate)
+		}
+	}
+
+	report, err := Aggregate(bytes.NewReader(data), WithTop(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != c.Users {
+		t.Fatalf("expected %d users, got %d", c.Users, report.Users)
+	}
+	if len(report.Countries) != len(countries)+1 || len(report.Companies) != len(companies)+1 {
+		t.Errorf("unexpected countries %v or companies %v", report.Countries, report.Companies)
+	}
+	if report.UniqueBrowsers < c.Users {
+		t.Errorf("expected many unique browsers, got %d", report.UniqueBrowsers)
+	}
+}
+
+func TestGeneratedSearch(t *testing.T) {
+	data := generate(t, DefaultGeneratorConfig(3000))
+	if lines := bytes.Split(data, []byte("\n")); len(lines) != 3001 || len(lines[3000]) != 0 {
+		t.Fatalf("expected 3000 lines ending with a newline, got %d", len(lines))
+	}
+	if !strings.HasPrefix(string(data), `{"browsers":[`) || !strings.Contains(string(data), `,"phone":"`) {
+		t.Errorf("unexpected schema:\n%.300s", data)
+	}
+
+	expected := new(bytes.Buffer)
+	if err := SlowSearchReader(expected, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := Search(out, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected.String() {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected)
+	}
+}
+
+func TestGeneratorConfigErrors(t *testing.T) {
+	for _, change := range []func(c *GeneratorConfig){
+		func(c *GeneratorConfig) { c.Users = -1 },
+		func(c *GeneratorConfig) { c.Browsers = 1 },
+		func(c *GeneratorConfig) { c.Predicates[0].Rate = 1.5 },
+		func(c *GeneratorConfig) { c.Predicates[1].Rate = -0.1 },
+		func(c *GeneratorConfig) { c.Predicates[1].Value = "" },
+		func(c *GeneratorConfig) { c.Predicates[1].Field = FieldName },
+		func(c *GeneratorConfig) {
+			c.Predicates = append(c.Predicates, GeneratedRate{FieldCompany, "A", 0.6}, GeneratedRate{FieldCompany, "B", 0.6})
+		},
+		func(c *GeneratorConfig) { c.Predicates = append(c.Predicates, GeneratedRate{FieldBrowsers, "/", 0.1}) },
+		// every job has an e
+		func(c *GeneratorConfig) { c.Predicates = append(c.Predicates, GeneratedRate{FieldJob, "e", 0.1}) },
+	} {
+		c := DefaultGeneratorConfig(10)
+		change(&c)
+		if err := Generate(ioutil.Discard, c); err == nil {
+			t.Errorf("expected an error for %+v", c)
+		}
+	}
+}
+
+// go test -bench Generated -benchmem
+// compares ways to search files too large for data/users.txt to show
+func BenchmarkGenerated(b *testing.B) {
+	for _, users := range []int{10000, benchUsers} {
+		path, cleanup := generatedFile(b, users)
+		defer cleanup()
+		ix, err := BuildIndex(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		for _, bench := range []struct {
+			name   string
+			search func() error
+		}{
+			{"fast", func() error { return SearchFile(ioutil.Discard, path) }},
+			{"parallel", func() error { return SearchFile(ioutil.Discard, path, WithWorkers(0)) }},
+			{"index", func() error { return ix.Search(ioutil.Discard) }},
+		} {
+			search := bench.search
+			b.Run(fmt.Sprintf("users=%d/%s", users, bench.name), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := search(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
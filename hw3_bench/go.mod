@@ -0,0 +1,10 @@
+module hw3_bench
+
+go 1.22
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/mailru/easyjson v0.9.2
+)
+
+require github.com/josharian/intern v1.0.0 // indirect
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	jlexer "github.com/mailru/easyjson/jlexer"
+)
+
+const indexVersion = 1
+
+// ErrStaleIndex means the users file has been changed other than by appending lines
+var ErrStaleIndex = errors.New("users file has changed since it was indexed")
+
+// Index is an inverted index of user browsers, it finds users with browser predicates
+// without reading the whole users file. Only lines ending with a newline are indexed.
+type Index struct {
+	usersPath string
+	data      indexData
+	// browserIDs is the dictionary the other way round, it is rebuilt on load
+	browserIDs map[string]int32
+}
+
+// indexData is what is saved on disk
+type indexData struct {
+	Version int
+	// Size is the number of indexed bytes at the start of the users file
+	Size int64
+	// LastLine is the checksum of the last indexed line, to tell appended files from rewritten ones
+	LastLine uint32
+	// Offsets are offsets of indexed lines in the users file
+	Offsets []int64
+	// Browsers is the dictionary of browsers met in indexed lines
+	Browsers []string
+	// Users are ascending numbers of lines with every browser of the dictionary
+	Users [][]int32
+	// Trigrams are ascending ids of browsers which contain every three bytes substring
+	Trigrams map[string][]int32
+}
+
+// BuildIndex indexes the users file at path
+func BuildIndex(path string) (*Index, error) {
+	ix := &Index{
+		usersPath: path,
+		data: indexData{
+			Version:  indexVersion,
+			Trigrams: make(map[string][]int32),
+		},
+		browserIDs: make(map[string]int32),
+	}
+	if _, err := ix.Update(); err != nil {
+		return nil, err
+	}
+	return ix, nil
+}
+
+// LoadIndex reads the index of the users file at usersPath saved by Save
+func LoadIndex(indexPath, usersPath string) (*Index, error) {
+	file, err := os.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ix := &Index{usersPath: usersPath}
+	if err := gob.NewDecoder(bufio.NewReader(file)).Decode(&ix.data); err != nil {
+		return nil, fmt.Errorf("%s: %v", indexPath, err)
+	}
+	if ix.data.Version != indexVersion {
+		return nil, fmt.Errorf("%s: unsupported index version %d", indexPath, ix.data.Version)
+	}
+	if ix.data.Trigrams == nil {
+		ix.data.Trigrams = make(map[string][]int32)
+	}
+
+	ix.browserIDs = make(map[string]int32, len(ix.data.Browsers))
+	for id, browser := range ix.data.Browsers {
+		ix.browserIDs[browser] = int32(id)
+	}
+	return ix, nil
+}
+
+// Save writes the index to path, the file is replaced at once so readers never see half of it
+func (ix *Index) Save(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	err = gob.NewEncoder(w).Encode(&ix.data)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Lines is the number of indexed users
+func (ix *Index) Lines() int {
+	return len(ix.data.Offsets)
+}
+
+// Update indexes lines appended to the users file since the last update
+// and returns how many lines have been added
+func (ix *Index) Update() (int, error) {
+	file, err := os.Open(ix.usersPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if err := ix.check(file); err != nil {
+		return 0, err
+	}
+	if _, err := file.Seek(ix.data.Size, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	before := ix.Lines()
+	reader := bufio.NewReader(file)
+	var user User
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ix.Lines() - before, err
+		}
+
+		user = User{Browsers: user.Browsers[:0]}
+		lexer := jlexer.Lexer{Data: line}
+		decodeUser(&lexer, &user, FieldBrowsers.mask())
+		if err := lexer.Error(); err != nil {
+			return ix.Lines() - before, &LineError{Line: ix.Lines() + 1, Err: err}
+		}
+
+		ix.add(&user, line)
+	}
+	return ix.Lines() - before, nil
+}
+
+func (ix *Index) add(user *User, line []byte) {
+	n := int32(len(ix.data.Offsets))
+	ix.data.Offsets = append(ix.data.Offsets, ix.data.Size)
+	ix.data.Size += int64(len(line))
+	ix.data.LastLine = crc32.ChecksumIEEE(line)
+
+	for _, browser := range user.Browsers {
+		id, ok := ix.browserIDs[browser]
+		if !ok {
+			id = int32(len(ix.data.Browsers))
+			ix.browserIDs[browser] = id
+			ix.data.Browsers = append(ix.data.Browsers, browser)
+			ix.data.Users = append(ix.data.Users, nil)
+			for _, tri := range trigrams(browser) {
+				ix.data.Trigrams[tri] = append(ix.data.Trigrams[tri], id)
+			}
+		}
+		// a user may have the same browser twice
+		if users := ix.data.Users[id]; len(users) == 0 || users[len(users)-1] != n {
+			ix.data.Users[id] = append(users, n)
+		}
+	}
+}
+
+// trigrams returns distinct three bytes substrings of s
+func trigrams(s string) []string {
+	var res []string
+	seen := make(map[string]bool)
+	for i := 0; i+3 <= len(s); i++ {
+		if tri := s[i : i+3]; !seen[tri] {
+			seen[tri] = true
+			res = append(res, tri)
+		}
+	}
+	return res
+}
+
+// check makes sure the indexed part of the file is still there
+func (ix *Index) check(file *os.File) error {
+	if len(ix.data.Offsets) == 0 {
+		return nil
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() < ix.data.Size {
+		return ErrStaleIndex
+	}
+
+	last := ix.data.Offsets[len(ix.data.Offsets)-1]
+	line := make([]byte, ix.data.Size-last)
+	if _, err := file.ReadAt(line, last); err != nil {
+		return err
+	}
+	if crc32.ChecksumIEEE(line) != ix.data.LastLine {
+		return ErrStaleIndex
+	}
+	return nil
+}
+
+// Search is SearchFile with the index. Indexed lines are read only for users the index can't rule out,
+// queries without browser predicates which narrow them down read them all. Lines appended since
+// the last update, like the last line without a newline, are scanned.
+// The index has only lines which can be parsed, so a lenient search reads the whole file.
+func (ix *Index) Search(out io.Writer, opts ...SearchOption) error {
+	o, err := newSearchOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(ix.usersPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := ix.check(file); err != nil {
+		return err
+	}
+	if o.lenient {
+		return fastSearch(out, file, o)
+	}
+
+	q := o.query
+	browsers := make([][]int32, len(q.browsers))
+	seenBrowsers := make(map[int32]bool)
+	for _, n := range q.browsers {
+		browsers[n.bit] = ix.matchBrowsers(n)
+		for _, id := range browsers[n.bit] {
+			seenBrowsers[id] = true
+		}
+	}
+
+	lines, known := ix.candidates(q.root, browsers)
+	if !known {
+		return fastSearch(out, file, o)
+	}
+
+	w := o.newResultWriter(out)
+	if err := w.begin(); err != nil {
+		return err
+	}
+
+	var user User
+	var buf []byte
+	for _, n := range lines {
+		start, end := ix.data.Offsets[n], ix.data.Size
+		if int(n)+1 < len(ix.data.Offsets) {
+			end = ix.data.Offsets[n+1]
+		}
+		if int64(cap(buf)) < end-start {
+			buf = make([]byte, end-start)
+		}
+		buf = buf[:end-start]
+		if _, err := file.ReadAt(buf, start); err != nil {
+			return err
+		}
+
+		user = User{Browsers: user.Browsers[:0]}
+		lexer := jlexer.Lexer{Data: buf}
+		decodeUser(&lexer, &user, o.decodeFields())
+		if err := lexer.Error(); err != nil {
+			return &LineError{Line: int(n) + 1, Err: err}
+		}
+
+		if q.Match(&user) {
+			if err := w.user(int(n), &user); err != nil {
+				return err
+			}
+		}
+	}
+
+	unique, err := ix.searchTail(file, o, w, seenBrowsers)
+	if err != nil {
+		return err
+	}
+	return w.end(unique, nil)
+}
+
+// searchTail writes users found in lines after the indexed ones
+// and returns the number of unique browsers in the whole file
+func (ix *Index) searchTail(file *os.File, o *searchOptions, w resultWriter, seenBrowsers map[int32]bool) (int, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	var writeErr error
+	tailBrowsers := make(map[string]bool)
+	tail := io.NewSectionReader(file, ix.data.Size, info.Size()-ix.data.Size)
+	_, err = scanUsers(tail, o, tailBrowsers, nil, func(i int, user *User) {
+		if writeErr == nil {
+			writeErr = w.user(ix.Lines()+i, user)
+		}
+	})
+	if lineErr, ok := err.(*LineError); ok {
+		lineErr.Line += ix.Lines()
+	}
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	unique := len(seenBrowsers)
+	for browser := range tailBrowsers {
+		if id, ok := ix.browserIDs[browser]; !ok || !seenBrowsers[id] {
+			unique++
+		}
+	}
+	return unique, nil
+}
+
+// matchBrowsers returns ids of browsers which satisfy the predicate
+func (ix *Index) matchBrowsers(n *queryNode) []int32 {
+	var ids []int32
+	if n.re != nil || len(n.substr) < 3 {
+		for id, browser := range ix.data.Browsers {
+			if n.test(browser) {
+				ids = append(ids, int32(id))
+			}
+		}
+		return ids
+	}
+
+	for i, tri := range trigrams(n.substr) {
+		if i == 0 {
+			ids = ix.data.Trigrams[tri]
+		} else {
+			ids = intersectLines(ids, ix.data.Trigrams[tri])
+		}
+	}
+
+	var res []int32
+	for _, id := range ids {
+		if strings.Contains(ix.data.Browsers[id], n.substr) {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+// candidates returns ascending numbers of lines which may satisfy the expression,
+// known is false if the index can't tell and every line may
+func (ix *Index) candidates(n *queryNode, browsers [][]int32) (lines []int32, known bool) {
+	switch n.op {
+	case opAnd:
+		for _, arg := range n.args {
+			argLines, argKnown := ix.candidates(arg, browsers)
+			if !argKnown {
+				continue
+			}
+			if !known {
+				lines, known = argLines, true
+			} else {
+				lines = intersectLines(lines, argLines)
+			}
+		}
+		return lines, known
+
+	case opOr:
+		for _, arg := range n.args {
+			argLines, argKnown := ix.candidates(arg, browsers)
+			if !argKnown {
+				return nil, false
+			}
+			lines = unionLines(lines, argLines)
+		}
+		return lines, true
+
+	case opNot:
+		return nil, false
+	}
+
+	if n.field != FieldBrowsers {
+		return nil, false
+	}
+	// merging the lists one by one copies the result for every browser, which is quadratic
+	// when a predicate matches most of them, e.g. a substring of every browser of a large file
+	for _, id := range browsers[n.bit] {
+		lines = append(lines, ix.data.Users[id]...)
+	}
+	sort.Slice(lines, func(i, j int) bool {
+		return lines[i] < lines[j]
+	})
+	return uniqueLines(lines), true
+}
+
+// uniqueLines removes repeated numbers from sorted lines
+func uniqueLines(lines []int32) []int32 {
+	res := lines[:0]
+	for i, n := range lines {
+		if i == 0 || n != lines[i-1] {
+			res = append(res, n)
+		}
+	}
+	return res
+}
+
+func intersectLines(a, b []int32) []int32 {
+	var res []int32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+func unionLines(a, b []int32) []int32 {
+	res := make([]int32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			res = append(res, a[i])
+			i++
+		case a[i] > b[j]:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var indexQueries = []string{
+	`browsers:"Android" and browsers:"MSIE"`,
+	`browsers:"Android"`,
+	`browsers:"MS" or browsers:"Opera"`,
+	`browsers:/MSIE [67]\./ and not country:"Russia"`,
+	`browsers:"Windows NT" and (job:/^Senior/ or browsers:"Firefox")`,
+	`not browsers:"Android"`,
+	`country:"Russia"`,
+	`browsers:"no such browser"`,
+}
+
+func checkIndexSearch(t *testing.T, ix *Index, usersPath string) {
+	for _, src := range indexQueries {
+		for _, format := range []Format{FormatText, FormatJSON} {
+			opts := []SearchOption{WithQuery(mustParseQuery(t, src)), WithFormat(format), WithFields(FieldName, FieldBrowsers)}
+
+			expected := new(bytes.Buffer)
+			if err := SearchFile(expected, usersPath, opts...); err != nil {
+				t.Fatal(err)
+			}
+			out := new(bytes.Buffer)
+			if err := ix.Search(out, opts...); err != nil {
+				t.Fatalf("%s: %v", src, err)
+			}
+			if out.String() != expected.String() {
+				t.Errorf("%s: results not match\nGot:\n%v\nExpected:\n%v", src, out, expected)
+			}
+		}
+	}
+}
+
+func TestIndexSearch(t *testing.T) {
+	ix, err := BuildIndex(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last line has no newline
+	if ix.Lines() != 999 {
+		t.Errorf("expected 999 lines, got %d", ix.Lines())
+	}
+	checkIndexSearch(t, ix, filePath)
+
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	indexPath := filepath.Join(dir, "users.idx")
+
+	if err := ix.Save(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadIndex(indexPath, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexSearch(t, loaded, filePath)
+}
+
+func TestIndexUpdate(t *testing.T) {
+	data := readUsers(t)
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	usersPath := filepath.Join(dir, "users.txt")
+	indexPath := filepath.Join(dir, "users.idx")
+
+	// start with a half written line
+	half := bytes.Index(data[len(data)/2:], []byte("\n")) + len(data)/2 + 20
+	if err := ioutil.WriteFile(usersPath, data[:half], 0644); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := BuildIndex(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.Save(indexPath); err != nil {
+		t.Fatal(err)
+	}
+	indexed := ix.Lines()
+
+	// the half written line is read and can't be parsed
+	for name, err := range map[string]error{
+		"file":  SearchFile(ioutil.Discard, usersPath),
+		"index": ix.Search(ioutil.Discard),
+	} {
+		var lineErr *LineError
+		if !errors.As(err, &lineErr) || lineErr.Line != indexed+1 {
+			t.Errorf("%s: expected an error in line %d, got %v", name, indexed+1, err)
+		}
+	}
+
+	f, err := os.OpenFile(usersPath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data[half:])
+	f.Write([]byte("\n"))
+	f.Close()
+
+	ix, err = LoadIndex(indexPath, usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// lines which are not indexed yet are scanned
+	checkIndexSearch(t, ix, usersPath)
+
+	added, err := ix.Update()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added != 1000-indexed || ix.Lines() != 1000 {
+		t.Errorf("expected %d added lines, got %d of %d", 1000-indexed, added, ix.Lines())
+	}
+	checkIndexSearch(t, ix, usersPath)
+
+	if added, err := ix.Update(); added != 0 || err != nil {
+		t.Errorf("nothing to update, got %d lines, %v", added, err)
+	}
+}
+
+func TestIndexLenientSearch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	usersPath := filepath.Join(dir, "users.txt")
+
+	users := `{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}` + "\n"
+	if err := ioutil.WriteFile(usersPath, []byte(users), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := BuildIndex(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users += "not json\n" + `{"browsers":["Android 2","MSIE 6"],"name":"B","email":"b@b"}`
+	if err := ioutil.WriteFile(usersPath, []byte(users), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := ix.Search(out, WithLenient()); err != nil {
+		t.Fatal(err)
+	}
+	expected := "found users:\n[0] A <a [at] a>\n[2] B <b [at] b>\n\nTotal unique browsers 4\nMalformed lines 1: 2\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestStaleIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	usersPath := filepath.Join(dir, "users.txt")
+
+	users := []byte(`{"browsers":["Android"],"name":"A","email":"a@a"}` + "\n" +
+		`{"browsers":["MSIE"],"name":"B","email":"b@b"}` + "\n")
+	if err := ioutil.WriteFile(usersPath, users, 0644); err != nil {
+		t.Fatal(err)
+	}
+	ix, err := BuildIndex(usersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, changed := range [][]byte{
+		users[:len(users)-10],
+		bytes.Replace(users, []byte("MSIE"), []byte("Edge"), 1),
+	} {
+		if err := ioutil.WriteFile(usersPath, changed, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ix.Update(); err != ErrStaleIndex {
+			t.Errorf("expected stale index on update, got %v", err)
+		}
+		if err := ix.Search(ioutil.Discard); err != ErrStaleIndex {
+			t.Errorf("expected stale index on search, got %v", err)
+		}
+	}
+}
+
+func TestLineSets(t *testing.T) {
+	a, b := []int32{1, 3, 5, 7}, []int32{2, 3, 7, 8, 9}
+	if res := intersectLines(a, b); len(res) != 2 || res[0] != 3 || res[1] != 7 {
+		t.Errorf("intersection %v", res)
+	}
+	if res := unionLines(a, b); len(res) != 7 || res[0] != 1 || res[6] != 9 {
+		t.Errorf("union %v", res)
+	}
+	if res := uniqueLines([]int32{1, 1, 2, 3, 3, 3, 8}); !reflect.DeepEqual(res, []int32{1, 2, 3, 8}) {
+		t.Errorf("unique %v", res)
+	}
+}
+
+func TestIndexCandidates(t *testing.T) {
+	ix := &Index{data: indexData{Trigrams: make(map[string][]int32)}, browserIDs: make(map[string]int32)}
+	// every user shares browsers with many others, so lists of a predicate overlap
+	var users []*User
+	for i := 0; i < 500; i++ {
+		user := &User{Browsers: []string{
+			fmt.Sprintf("Browser %d", i%7),
+			fmt.Sprintf("Browser %d", i%11),
+			fmt.Sprintf("Browser %d", i),
+		}}
+		users = append(users, user)
+		ix.add(user, []byte("{}\n"))
+	}
+
+	for _, src := range []string{
+		`browsers:"Browser"`,
+		`browsers:"Browser 3"`,
+		`browsers:/ [13]$/`,
+		`browsers:"Browser 1" and browsers:"Browser 2"`,
+		`browsers:"Browser 4" or browsers:"Browser 5"`,
+	} {
+		q := mustParseQuery(t, src)
+		browsers := make([][]int32, len(q.browsers))
+		for _, n := range q.browsers {
+			browsers[n.bit] = ix.matchBrowsers(n)
+		}
+		lines, known := ix.candidates(q.root, browsers)
+		if !known {
+			t.Fatalf("%s: the index should know the lines", src)
+		}
+
+		var expected []int32
+		for i, user := range users {
+			if q.Match(user) {
+				expected = append(expected, int32(i))
+			}
+		}
+		if !reflect.DeepEqual(lines, expected) {
+			t.Errorf("%s: expected lines %v, got %v", src, expected, lines)
+		}
+	}
+}
+
+func BenchmarkIndexSearch(b *testing.B) {
+	path, cleanup := generatedFile(b, benchUsers)
+	defer cleanup()
+	ix, err := BuildIndex(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := ix.Search(ioutil.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
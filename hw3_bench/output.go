@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	jwriter "github.com/mailru/easyjson/jwriter"
+)
+
+// Format is how found users are written
+type Format int
+
+const (
+	// FormatText is the output of SlowSearch
+	FormatText Format = iota
+	// FormatJSON writes a JSON object per line for every found user
+	FormatJSON
+	// FormatCSV writes a header and a row for every found user, browsers are joined with |
+	FormatCSV
+)
+
+// WithFormat sets the output format, JSON and CSV have no count of unique browsers
+// and no report of malformed lines, WithMalformedReport gets it for them.
+func WithFormat(f Format) SearchOption {
+	return func(o *searchOptions) {
+		o.format = f
+	}
+}
+
+// WithFields sets fields of found users written as JSON or CSV, name and email by default.
+// The index of the user line always comes first.
+func WithFields(fields ...Field) SearchOption {
+	return func(o *searchOptions) {
+		o.fields = fields
+	}
+}
+
+// WithRawEmail writes emails as they are instead of replacing @ with " [at] "
+func WithRawEmail() SearchOption {
+	return func(o *searchOptions) {
+		o.rawEmail = true
+	}
+}
+
+// decodeFields are the fields the query and the output need
+func (o *searchOptions) decodeFields() fieldMask {
+	fields := o.query.fields
+	for _, f := range o.fields {
+		fields |= f.mask()
+	}
+	return fields
+}
+
+func (o *searchOptions) email(email string) string {
+	if o.rawEmail {
+		return email
+	}
+	return strings.Replace(email, "@", " [at] ", 1)
+}
+
+// resultWriter writes found users in some format, i is the index of the user line.
+// malformed is nil unless the search is lenient, only the text ends with it.
+type resultWriter interface {
+	begin() error
+	user(i int, u *User) error
+	end(uniqueBrowsers int, malformed *Malformed) error
+}
+
+func (o *searchOptions) newResultWriter(out io.Writer) resultWriter {
+	switch o.format {
+	case FormatJSON:
+		return &jsonWriter{out: out, o: o}
+	case FormatCSV:
+		return &csvWriter{out: csv.NewWriter(out), o: o}
+	}
+	return &textWriter{out: out, o: o}
+}
+
+type textWriter struct {
+	out io.Writer
+	o   *searchOptions
+}
+
+func (w *textWriter) begin() error {
+	_, err := fmt.Fprintln(w.out, "found users:")
+	return err
+}
+
+func (w *textWriter) user(i int, u *User) error {
+	_, err := fmt.Fprintln(w.out, "["+strconv.Itoa(i)+"] "+u.Name+" <"+w.o.email(u.Email)+">")
+	return err
+}
+
+func (w *textWriter) end(uniqueBrowsers int, malformed *Malformed) error {
+	_, err := fmt.Fprintln(w.out, "\nTotal unique browsers", uniqueBrowsers)
+	if err == nil && malformed != nil {
+		_, err = fmt.Fprintln(w.out, malformed)
+	}
+	return err
+}
+
+type jsonWriter struct {
+	out io.Writer
+	o   *searchOptions
+}
+
+func (w *jsonWriter) begin() error {
+	return nil
+}
+
+func (w *jsonWriter) user(i int, u *User) error {
+	out := jwriter.Writer{}
+	out.RawString(`{"index":`)
+	out.Int(i)
+	for _, f := range w.o.fields {
+		out.RawString(`,"` + f.String() + `":`)
+		if f != FieldBrowsers {
+			out.String(w.o.field(u, f))
+			continue
+		}
+		out.RawByte('[')
+		for j, browser := range u.Browsers {
+			if j > 0 {
+				out.RawByte(',')
+			}
+			out.String(browser)
+		}
+		out.RawByte(']')
+	}
+	out.RawString("}\n")
+
+	_, err := out.DumpTo(w.out)
+	return err
+}
+
+func (w *jsonWriter) end(uniqueBrowsers int, malformed *Malformed) error {
+	return nil
+}
+
+type csvWriter struct {
+	out *csv.Writer
+	o   *searchOptions
+	row []string
+}
+
+func (w *csvWriter) begin() error {
+	header := []string{"index"}
+	for _, f := range w.o.fields {
+		header = append(header, f.String())
+	}
+	return w.out.Write(header)
+}
+
+func (w *csvWriter) user(i int, u *User) error {
+	w.row = append(w.row[:0], strconv.Itoa(i))
+	for _, f := range w.o.fields {
+		if f == FieldBrowsers {
+			w.row = append(w.row, strings.Join(u.Browsers, "|"))
+		} else {
+			w.row = append(w.row, w.o.field(u, f))
+		}
+	}
+	return w.out.Write(w.row)
+}
+
+func (w *csvWriter) end(uniqueBrowsers int, malformed *Malformed) error {
+	w.out.Flush()
+	return w.out.Error()
+}
+
+// field is the user field as it is written, with the email obfuscated if needed
+func (o *searchOptions) field(u *User, f Field) string {
+	if f == FieldEmail {
+		return o.email(u.Email)
+	}
+	return u.field(f)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const outputUsers = `{"browsers":["Android 4","MSIE 9"],"company":"Yandex","country":"Russia","email":"ivan@mail.ru","job":"Developer","name":"Ivan, \"the\" Great"}
+{"browsers":["Opera"],"company":"Mail","country":"Russia","email":"petr@mail.ru","job":"QA","name":"Petr"}
+{"browsers":["MSIE 6","Android 2"],"email":"anna@gmail.com","name":"Anna"}
+`
+
+func searchOutput(t *testing.T, opts ...SearchOption) string {
+	out := new(bytes.Buffer)
+	if err := Search(out, strings.NewReader(outputUsers), opts...); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestTextOutput(t *testing.T) {
+	expected := "found users:\n[0] Ivan, \"the\" Great <ivan [at] mail.ru>\n[2] Anna <anna [at] gmail.com>\n\nTotal unique browsers 4\n"
+	if out := searchOutput(t); out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+
+	expected = strings.Replace(expected, " [at] ", "@", -1)
+	if out := searchOutput(t, WithRawEmail()); out != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	out := searchOutput(t, WithFormat(FormatJSON), WithRawEmail(),
+		WithFields(FieldName, FieldEmail, FieldBrowsers, FieldCountry))
+
+	type jsonUser struct {
+		Index    int
+		Name     string
+		Email    string
+		Browsers []string
+		Country  string
+		Job      *string
+	}
+	expected := []jsonUser{
+		{Index: 0, Name: `Ivan, "the" Great`, Email: "ivan@mail.ru", Browsers: []string{"Android 4", "MSIE 9"}, Country: "Russia"},
+		{Index: 2, Name: "Anna", Email: "anna@gmail.com", Browsers: []string{"MSIE 6", "Android 2"}},
+	}
+
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines, got\n%s", len(expected), out)
+	}
+	for i, line := range lines {
+		var u jsonUser
+		if err := json.Unmarshal([]byte(line), &u); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+		if !reflect.DeepEqual(u, expected[i]) {
+			t.Errorf("expected %+v, got %+v", expected[i], u)
+		}
+	}
+}
+
+func TestCSVOutput(t *testing.T) {
+	out := searchOutput(t, WithFormat(FormatCSV), WithFields(FieldName, FieldEmail, FieldBrowsers, FieldJob),
+		WithQuery(mustParseQuery(t, `country:"Russia"`)))
+
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"index", "name", "email", "browsers", "job"},
+		{"0", `Ivan, "the" Great`, "ivan [at] mail.ru", "Android 4|MSIE 9", "Developer"},
+		{"1", "Petr", "petr [at] mail.ru", "Opera", "QA"},
+	}
+	if !reflect.DeepEqual(records, expected) {
+		t.Errorf("expected %q, got %q", expected, records)
+	}
+}
+
+func TestLenientOutput(t *testing.T) {
+	input := `{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}` + "\n" +
+		"not json\n" +
+		`{"browsers":["Android 2","MSIE 6"],"name":"B","email":"b@b"}` + "\n" +
+		"{\n"
+
+	// malformed lines are counted from 1 like in LineError, they are not in the records
+	want := Malformed{Count: 2, Lines: []int{2, 4}}
+	out := new(bytes.Buffer)
+	var malformed Malformed
+	if err := Search(out, strings.NewReader(input), WithMalformedReport(&malformed), WithFormat(FormatJSON), WithFields(FieldName)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"index":0,"name":"A"}` + "\n" + `{"index":2,"name":"B"}` + "\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+	if !reflect.DeepEqual(malformed, want) {
+		t.Errorf("expected the report %+v, got %+v", want, malformed)
+	}
+
+	for _, fields := range []int{1, 4} {
+		out.Reset()
+		malformed = Malformed{}
+		fieldsOpt := WithFields([]Field{FieldName, FieldEmail, FieldJob, FieldCountry}[:fields]...)
+		if err := Search(out, strings.NewReader(input), WithMalformedReport(&malformed), WithFormat(FormatCSV), fieldsOpt); err != nil {
+			t.Fatal(err)
+		}
+		// every row is as wide as the header and starts with an index
+		records, err := csv.NewReader(out).ReadAll()
+		if err != nil {
+			t.Fatalf("%d fields: %v", fields, err)
+		}
+		if len(records) != 3 {
+			t.Fatalf("%d fields: expected the header and 2 users, got %q", fields, records)
+		}
+		for _, record := range records[1:] {
+			if _, err := strconv.Atoi(record[0]); err != nil || len(record) != fields+1 {
+				t.Errorf("%d fields: bad row %q", fields, record)
+			}
+		}
+		if !reflect.DeepEqual(malformed, want) {
+			t.Errorf("%d fields: expected the report %+v, got %+v", fields, want, malformed)
+		}
+	}
+
+	// WithLenient alone skips the lines without a report
+	out.Reset()
+	if err := Search(out, strings.NewReader(input), WithLenient(), WithFormat(FormatJSON), WithFields(FieldName)); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out)
+	}
+}
+
+func TestParallelJSONOutput(t *testing.T) {
+	opts := []SearchOption{
+		WithFormat(FormatJSON),
+		WithFields(FieldBrowsers, FieldName, FieldEmail, FieldCompany),
+		WithQuery(mustParseQuery(t, `browsers:"Android"`)),
+	}
+
+	expected := new(bytes.Buffer)
+	if err := SearchFile(expected, filePath, opts...); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	if err := SearchFile(out, filePath, append(opts, WithWorkers(4))...); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected.String() {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected)
+	}
+}
+
+func TestOutputOptionErrors(t *testing.T) {
+	if err := Search(new(bytes.Buffer), strings.NewReader(outputUsers), WithFormat(Format(7))); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if err := Search(new(bytes.Buffer), strings.NewReader(outputUsers), WithFields(FieldName, Field(-1))); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
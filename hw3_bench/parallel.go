@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// chunksPerWorker splits the file into more chunks than workers,
+// so a worker which got a chunk of short lines doesn't wait for the rest
+const chunksPerWorker = 4
+
+// ParallelSearch is FastSearchQuery which parses and filters the file on several goroutines,
+// it uses a goroutine per CPU if workers is not positive. The output is the same.
+func ParallelSearch(out io.Writer, q *Query, workers int) {
+	if err := SearchFile(out, filePath, WithQuery(q), WithWorkers(workers)); err != nil {
+		panic(err)
+	}
+}
+
+type foundUser struct {
+	line int
+	user User
+}
+
+// chunkResult is what a worker found in a chunk, lines are numbered from the chunk start
+type chunkResult struct {
+	lines        int
+	found        []foundUser
+	seenBrowsers map[string]bool
+	malformed    *Malformed
+	err          error
+}
+
+func searchParallel(out io.Writer, r io.ReaderAt, size int64, o *searchOptions) error {
+	workers := o.workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	bounds, err := chunkBounds(r, size, workers*chunksPerWorker)
+	if err != nil {
+		return err
+	}
+	results := make([]chunkResult, len(bounds)-1)
+
+	chunks := make(chan int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				results[c] = searchChunk(io.NewSectionReader(r, bounds[c], bounds[c+1]-bounds[c]), o)
+			}
+		}()
+	}
+	for c := range results {
+		chunks <- c
+	}
+	close(chunks)
+	wg.Wait()
+
+	w := o.newResultWriter(out)
+	if err := w.begin(); err != nil {
+		return err
+	}
+
+	seenBrowsers := make(map[string]bool)
+	malformed := o.newMalformed()
+	first := 0
+	for _, res := range results {
+		if res.err != nil {
+			if lineErr, ok := res.err.(*LineError); ok {
+				lineErr.Line += first
+			}
+			return res.err
+		}
+		for _, f := range res.found {
+			if err := w.user(first+f.line, &f.user); err != nil {
+				return err
+			}
+		}
+		for browser := range res.seenBrowsers {
+			seenBrowsers[browser] = true
+		}
+		if malformed != nil {
+			malformed.merge(res.malformed, first)
+		}
+		first += res.lines
+	}
+
+	o.reportMalformed(malformed)
+	return w.end(len(seenBrowsers), malformed)
+}
+
+func searchChunk(r io.Reader, o *searchOptions) chunkResult {
+	res := chunkResult{seenBrowsers: make(map[string]bool), malformed: o.newMalformed()}
+	res.lines, res.err = scanUsers(r, o, res.seenBrowsers, res.malformed, func(i int, user *User) {
+		found := foundUser{line: i, user: *user}
+		// the scanner reuses the slice for the next user
+		found.user.Browsers = append([]string(nil), user.Browsers...)
+		res.found = append(res.found, found)
+	})
+	return res
+}
+
+// chunkBounds splits r into at most n chunks of about the same size which start at line starts,
+// chunk i is [bounds[i], bounds[i+1]). Lines longer than a chunk make fewer chunks.
+func chunkBounds(r io.ReaderAt, size int64, n int) ([]int64, error) {
+	bounds := []int64{0}
+	buf := make([]byte, 4096)
+
+	for i := 1; i < n; i++ {
+		pos := size * int64(i) / int64(n)
+		if last := bounds[len(bounds)-1]; pos <= last {
+			continue
+		}
+
+		// the chunk starts after the first newline at pos-1 or later
+		pos--
+		for pos < size {
+			m, err := r.ReadAt(buf, pos)
+			if k := bytes.IndexByte(buf[:m], '\n'); k >= 0 {
+				pos += int64(k) + 1
+				break
+			}
+			pos += int64(m)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		if pos >= size {
+			break
+		}
+		bounds = append(bounds, pos)
+	}
+
+	return append(bounds, size), nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestParallelSearch(t *testing.T) {
+	expected := new(bytes.Buffer)
+	FastSearch(expected)
+
+	for _, workers := range []int{0, 1, 2, 3, 7, 64} {
+		out := new(bytes.Buffer)
+		ParallelSearch(out, androidAndMSIE, workers)
+		if out.String() != expected.String() {
+			t.Errorf("%d workers: results not match\nGot:\n%v\nExpected:\n%v", workers, out, expected)
+		}
+	}
+}
+
+func TestSearchParallelNumbering(t *testing.T) {
+	long := strings.Repeat("Opera ", 1000)
+	data := strings.Join([]string{
+		`{"browsers":["Android"],"name":"A","email":"a@a"}`,
+		`{"browsers":["` + long + `"],"name":"B","email":"b@b"}`,
+		`{"browsers":["MSIE"],"name":"C","email":"c@c"}`,
+		`{"browsers":["Android 2"],"name":"D","email":"d@d"}`,
+		`{"browsers":["` + long + `Android"],"name":"E","email":"e@e"}`,
+		`{"browsers":["Android"],"name":"F","email":"f@f"}`,
+	}, "\n")
+	q := mustParseQuery(t, `browsers:"Android" or browsers:"MSIE"`)
+
+	for _, workers := range []int{1, 2, 5, 40} {
+		out := new(bytes.Buffer)
+		if err := searchParallel(out, strings.NewReader(data), int64(len(data)), &searchOptions{query: q, workers: workers}); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "found users:\n[0] A <a [at] a>\n[2] C <c [at] c>\n[3] D <d [at] d>\n[4] E <e [at] e>\n[5] F <f [at] f>\n\nTotal unique browsers 4\n"
+		if out.String() != expected {
+			t.Errorf("%d workers: expected\n%s\ngot\n%s", workers, expected, out)
+		}
+	}
+}
+
+func TestChunkBounds(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		n        int
+		expected []int64
+	}{
+		{"", 4, []int64{0, 0}},
+		{"aaa\nbbb\nccc\nddd\n", 1, []int64{0, 16}},
+		{"aaa\nbbb\nccc\nddd\n", 2, []int64{0, 8, 16}},
+		{"aaa\nbbb\nccc\nddd\n", 4, []int64{0, 4, 8, 12, 16}},
+		{"aaa\nbbb\nccc\nddd\n", 16, []int64{0, 4, 8, 12, 16}},
+		{"aaaaaaaaaa\nb\nc\n", 8, []int64{0, 11, 13, 15}},
+		{"aaaaaaaaaaaaaaa", 4, []int64{0, 15}},
+	} {
+		bounds, err := chunkBounds(strings.NewReader(tc.data), int64(len(tc.data)), tc.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bounds, tc.expected) {
+			t.Errorf("%q in %d chunks: expected %v, got %v", tc.data, tc.n, tc.expected, bounds)
+		}
+	}
+}
+
+// go test -bench Parallel -benchmem
+// shows how the search of a generated file scales with workers up to the number of CPUs
+func BenchmarkParallel(b *testing.B) {
+	path, cleanup := generatedFile(b, benchUsers)
+	defer cleanup()
+
+	counts := []int{1, 2, 4, 8}
+	if cpus := runtime.NumCPU(); cpus > 8 {
+		counts = append(counts, cpus)
+	}
+	for _, workers := range counts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := SearchFile(ioutil.Discard, path, WithWorkers(workers)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Field is a user field a predicate looks at
+type Field int
+
+const (
+	FieldBrowsers Field = iota
+	FieldCountry
+	FieldCompany
+	FieldJob
+	FieldName
+	FieldEmail
+)
+
+var fieldNames = map[string]Field{
+	"browsers": FieldBrowsers,
+	"browser":  FieldBrowsers,
+	"country":  FieldCountry,
+	"company":  FieldCompany,
+	"job":      FieldJob,
+	"name":     FieldName,
+	"email":    FieldEmail,
+}
+
+func (f Field) String() string {
+	switch f {
+	case FieldBrowsers:
+		return "browsers"
+	case FieldCountry:
+		return "country"
+	case FieldCompany:
+		return "company"
+	case FieldJob:
+		return "job"
+	case FieldName:
+		return "name"
+	case FieldEmail:
+		return "email"
+	}
+	return fmt.Sprintf("Field(%d)", int(f))
+}
+
+// fieldMask tells the decoder which fields to read
+type fieldMask uint
+
+func (f Field) mask() fieldMask {
+	return 1 << uint(f)
+}
+
+// outputFields are always needed to print a found user
+const outputFields = fieldMask(1<<FieldBrowsers | 1<<FieldName | 1<<FieldEmail)
+
+type exprOp int
+
+const (
+	opContains exprOp = iota
+	opMatch
+	opAnd
+	opOr
+	opNot
+)
+
+// Expr is a boolean expression of predicates over user fields.
+// A browsers predicate is true if any of the user browsers satisfies it.
+type Expr struct {
+	op    exprOp
+	field Field
+	arg   string
+	args  []Expr
+}
+
+// Contains is true if the field contains substr
+func Contains(field Field, substr string) Expr {
+	return Expr{op: opContains, field: field, arg: substr}
+}
+
+// Match is true if the field matches the regular expression
+func Match(field Field, pattern string) Expr {
+	return Expr{op: opMatch, field: field, arg: pattern}
+}
+
+func And(exprs ...Expr) Expr {
+	return Expr{op: opAnd, args: exprs}
+}
+
+func Or(exprs ...Expr) Expr {
+	return Expr{op: opOr, args: exprs}
+}
+
+func Not(expr Expr) Expr {
+	return Expr{op: opNot, args: []Expr{expr}}
+}
+
+func (e Expr) String() string {
+	switch e.op {
+	case opContains:
+		return e.field.String() + ":" + strconv.Quote(e.arg)
+	case opMatch:
+		return e.field.String() + ":/" + strings.Replace(e.arg, "/", `\/`, -1) + "/"
+	case opNot:
+		return "not " + e.args[0].String()
+	}
+
+	sep := " and "
+	if e.op == opOr {
+		sep = " or "
+	}
+	parts := make([]string, len(e.args))
+	for i, arg := range e.args {
+		parts[i] = arg.String()
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// maxBrowserPredicates is the number of bits in the mask of browser predicates matched by a user
+const maxBrowserPredicates = 64
+
+// Query is a compiled Expr, it doesn't change and can be used by many goroutines
+type Query struct {
+	root *queryNode
+	// Browser predicates are checked against every browser before the expression,
+	// browsers which satisfy any of them count as seen
+	browsers []*queryNode
+	fields   fieldMask
+	expr     Expr
+}
+
+type queryNode struct {
+	op     exprOp
+	field  Field
+	substr string
+	// substrBytes is substr for scanned users
+	substrBytes []byte
+	re          *regexp.Regexp
+	bit         uint
+	args        []*queryNode
+}
+
+// Compile checks the expression and compiles its regular expressions
+func Compile(e Expr) (*Query, error) {
+	q := &Query{fields: outputFields, expr: e}
+	root, err := q.compile(e)
+	if err != nil {
+		return nil, err
+	}
+	q.root = root
+	return q, nil
+}
+
+func MustCompile(e Expr) *Query {
+	q, err := Compile(e)
+	if err != nil {
+		panic(err)
+	}
+	return q
+}
+
+func (q *Query) compile(e Expr) (*queryNode, error) {
+	n := &queryNode{op: e.op, field: e.field}
+
+	switch e.op {
+	case opContains, opMatch:
+		if e.field < FieldBrowsers || e.field > FieldEmail {
+			return nil, fmt.Errorf("unknown field %v", e.field)
+		}
+		if e.op == opContains {
+			n.substr = e.arg
+			n.substrBytes = []byte(e.arg)
+		} else {
+			re, err := regexp.Compile(e.arg)
+			if err != nil {
+				return nil, err
+			}
+			n.re = re
+		}
+
+		q.fields |= e.field.mask()
+		if e.field == FieldBrowsers {
+			if len(q.browsers) == maxBrowserPredicates {
+				return nil, fmt.Errorf("too many browser predicates, at most %d are supported", maxBrowserPredicates)
+			}
+			n.bit = uint(len(q.browsers))
+			q.browsers = append(q.browsers, n)
+		}
+		return n, nil
+
+	case opAnd, opOr, opNot:
+		if e.op == opNot && len(e.args) != 1 {
+			return nil, fmt.Errorf("not needs one argument")
+		}
+		for _, arg := range e.args {
+			an, err := q.compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			n.args = append(n.args, an)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unknown operation %d", e.op)
+}
+
+func (q *Query) String() string {
+	return q.expr.String()
+}
+
+// Match tells whether the user satisfies the query
+func (q *Query) Match(u *User) bool {
+	return q.match(u, nil)
+}
+
+// match evaluates the query, browsers which satisfy browser predicates are added to seen.
+// All browser predicates are checked, so seen doesn't depend on the rest of the query.
+func (q *Query) match(u *User, seen map[string]bool) bool {
+	var hits uint64
+	for _, browser := range u.Browsers {
+		for _, n := range q.browsers {
+			if n.test(browser) {
+				hits |= 1 << n.bit
+				if seen != nil {
+					seen[browser] = true
+				}
+			}
+		}
+	}
+	return q.root.eval(u, hits)
+}
+
+// matchScanned is match for a user which hasn't been decoded
+func (q *Query) matchScanned(s *userScanner, seen map[string]bool) bool {
+	var hits uint64
+	for _, browser := range s.browsers {
+		for _, n := range q.browsers {
+			if n.testBytes(browser) {
+				hits |= 1 << n.bit
+				// the key is copied only for browsers met the first time
+				if seen != nil && !seen[string(browser)] {
+					seen[string(browser)] = true
+				}
+			}
+		}
+	}
+	return q.root.eval(s, hits)
+}
+
+func (n *queryNode) test(s string) bool {
+	if n.re != nil {
+		return n.re.MatchString(s)
+	}
+	return strings.Contains(s, n.substr)
+}
+
+func (n *queryNode) testBytes(b []byte) bool {
+	if n.re != nil {
+		return n.re.Match(b)
+	}
+	return bytes.Contains(b, n.substrBytes)
+}
+
+// fieldTester tests predicates over string fields of a decoded or a scanned user
+type fieldTester interface {
+	testField(n *queryNode) bool
+}
+
+func (u *User) testField(n *queryNode) bool {
+	return n.test(u.field(n.field))
+}
+
+func (s *userScanner) testField(n *queryNode) bool {
+	return n.testBytes(s.field(n.field))
+}
+
+func (n *queryNode) eval(u fieldTester, hits uint64) bool {
+	switch n.op {
+	case opAnd:
+		for _, arg := range n.args {
+			if !arg.eval(u, hits) {
+				return false
+			}
+		}
+		return true
+	case opOr:
+		for _, arg := range n.args {
+			if arg.eval(u, hits) {
+				return true
+			}
+		}
+		return false
+	case opNot:
+		return !n.args[0].eval(u, hits)
+	}
+
+	if n.field == FieldBrowsers {
+		return hits&(1<<n.bit) != 0
+	}
+	return u.testField(n)
+}
+
+func (u *User) field(f Field) string {
+	switch f {
+	case FieldCountry:
+		return u.Country
+	case FieldCompany:
+		return u.Company
+	case FieldJob:
+		return u.Job
+	case FieldName:
+		return u.Name
+	case FieldEmail:
+		return u.Email
+	}
+	return ""
+}
+
+// ParseQuery compiles a query written as text, e.g.
+//
+//	browsers:"Android" and (country:"Russia" or not job:/^Senior/)
+//
+// Terms are field:"substring" (a Go quoted string) or field:/regexp/,
+// they are combined with and, or, not and parentheses. And binds tighter than or.
+func ParseQuery(s string) (*Query, error) {
+	p := &queryParser{src: s}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.src) {
+		return nil, p.errorf("unexpected %q", p.src[p.pos:])
+	}
+	return Compile(e)
+}
+
+type queryParser struct {
+	src string
+	pos int
+}
+
+func (p *queryParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("query at %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *queryParser) skipSpace() {
+	for p.pos < len(p.src) && unicode.IsSpace(rune(p.src[p.pos])) {
+		p.pos++
+	}
+}
+
+// keyword consumes the word if it comes next
+func (p *queryParser) keyword(word string) bool {
+	p.skipSpace()
+	end := p.pos + len(word)
+	if end > len(p.src) || !strings.EqualFold(p.src[p.pos:end], word) {
+		return false
+	}
+	if end < len(p.src) && isWordByte(p.src[end]) {
+		return false
+	}
+	p.pos = end
+	return true
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+func (p *queryParser) parseOr() (Expr, error) {
+	e, err := p.parseAnd()
+	if err != nil {
+		return e, err
+	}
+	args := []Expr{e}
+	for p.keyword("or") {
+		e, err := p.parseAnd()
+		if err != nil {
+			return e, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return Or(args...), nil
+}
+
+func (p *queryParser) parseAnd() (Expr, error) {
+	e, err := p.parseUnary()
+	if err != nil {
+		return e, err
+	}
+	args := []Expr{e}
+	for p.keyword("and") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return e, err
+		}
+		args = append(args, e)
+	}
+	if len(args) == 1 {
+		return args[0], nil
+	}
+	return And(args...), nil
+}
+
+func (p *queryParser) parseUnary() (Expr, error) {
+	if p.keyword("not") {
+		e, err := p.parseUnary()
+		if err != nil {
+			return e, err
+		}
+		return Not(e), nil
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.src) && p.src[p.pos] == '(' {
+		p.pos++
+		e, err := p.parseOr()
+		if err != nil {
+			return e, err
+		}
+		if p.skipSpace(); p.pos >= len(p.src) || p.src[p.pos] != ')' {
+			return e, p.errorf("missing )")
+		}
+		p.pos++
+		return e, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseTerm() (Expr, error) {
+	start := p.pos
+	for p.pos < len(p.src) && isWordByte(p.src[p.pos]) {
+		p.pos++
+	}
+	name := p.src[start:p.pos]
+	if name == "" {
+		return Expr{}, p.errorf("expected a field name")
+	}
+	field, ok := fieldNames[strings.ToLower(name)]
+	if !ok {
+		p.pos = start
+		return Expr{}, p.errorf("unknown field %q", name)
+	}
+	if p.pos >= len(p.src) || p.src[p.pos] != ':' {
+		return Expr{}, p.errorf("expected : after %s", name)
+	}
+	p.pos++
+
+	if p.pos >= len(p.src) {
+		return Expr{}, p.errorf("expected a string or a regexp")
+	}
+	switch p.src[p.pos] {
+	case '"':
+		end := p.pos + 1
+		for end < len(p.src) && p.src[end] != '"' {
+			if p.src[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.src) {
+			return Expr{}, p.errorf("unterminated string")
+		}
+		substr, err := strconv.Unquote(p.src[p.pos : end+1])
+		if err != nil {
+			return Expr{}, p.errorf("bad string: %v", err)
+		}
+		p.pos = end + 1
+		return Contains(field, substr), nil
+
+	case '/':
+		var pattern strings.Builder
+		end := p.pos + 1
+		for ; end < len(p.src) && p.src[end] != '/'; end++ {
+			if p.src[end] == '\\' && end+1 < len(p.src) && p.src[end+1] == '/' {
+				end++
+			}
+			pattern.WriteByte(p.src[end])
+		}
+		if end >= len(p.src) {
+			return Expr{}, p.errorf("unterminated regexp")
+		}
+		p.pos = end + 1
+		return Match(field, pattern.String()), nil
+	}
+	return Expr{}, p.errorf("expected a string or a regexp")
+}
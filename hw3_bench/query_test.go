@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for src, expected := range map[string]string{
+		`browsers:"Android"`:                                     `browsers:"Android"`,
+		`browser:"Android" AND browsers:"MSIE"`:                  `(browsers:"Android" and browsers:"MSIE")`,
+		`country:"Russia" or company:"Yandex" and job:/^Senior/`: `(country:"Russia" or (company:"Yandex" and job:/^Senior/))`,
+		`not (name:"Ivan" or email:"@mail.ru")`:                  `not (name:"Ivan" or email:"@mail.ru")`,
+		`not not job:"\"quoted\""`:                               `not not job:"\"quoted\""`,
+		`email:/^[a-z]+\/[0-9]+$/`:                               `email:/^[a-z]+\/[0-9]+$/`,
+		`  ( browsers:"a" )  `:                                   `browsers:"a"`,
+	} {
+		q, err := ParseQuery(src)
+		if err != nil {
+			t.Errorf("%s: %v", src, err)
+			continue
+		}
+		if q.String() != expected {
+			t.Errorf("%s: expected %s, got %s", src, expected, q)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, src := range []string{
+		``,
+		`browsers`,
+		`browsers:`,
+		`browsers:Android`,
+		`phone:"123"`,
+		`browsers:"Android`,
+		`browsers:/Android`,
+		`browsers:"a" and`,
+		`(browsers:"a"`,
+		`browsers:"a" browsers:"b"`,
+		`browsers:"a" andbrowsers:"b"`,
+		`job:/[/`,
+	} {
+		if q, err := ParseQuery(src); err == nil {
+			t.Errorf("%s: expected an error, got %s", src, q)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	if _, err := Compile(Contains(Field(42), "x")); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+	if _, err := Compile(Not(Match(FieldName, "("))); err == nil {
+		t.Error("expected an error for a bad regexp")
+	}
+
+	var browsers []Expr
+	for i := 0; i <= maxBrowserPredicates; i++ {
+		browsers = append(browsers, Contains(FieldBrowsers, fmt.Sprint(i)))
+	}
+	if _, err := Compile(Or(browsers[:maxBrowserPredicates]...)); err != nil {
+		t.Error(err)
+	}
+	if _, err := Compile(Or(browsers...)); err == nil {
+		t.Error("expected an error for too many browser predicates")
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	user := &User{
+		Browsers: []string{"Mozilla/5.0 (Linux; Android 4.4)", "Opera/9.80 (Windows NT 6.1)"},
+		Company:  "Flashpoint",
+		Country:  "Dominican Republic",
+		Email:    "JonathanMorris@Muxo.edu",
+		Job:      "Senior Programmer Analyst",
+		Name:     "Sharon Crawford",
+	}
+
+	for src, expected := range map[string]bool{
+		`browsers:"Android"`:                              true,
+		`browsers:"Android" and browsers:"MSIE"`:          false,
+		`browsers:"Android" and not browsers:"MSIE"`:      true,
+		`browsers:"MSIE" or country:"Dominican"`:          true,
+		`browsers:"MSIE" or country:"Russia"`:             false,
+		`browsers:/^Opera\/9\.\d+/ and job:/^Senior/`:     true,
+		`job:/^Programmer/`:                               false,
+		`company:"Flashpoint" and name:"Sharon"`:          true,
+		`email:"@Muxo" and not (name:"Ivan" or job:"QA")`: true,
+		`not browsers:"Linux"`:                            false,
+	} {
+		if got := mustParseQuery(t, src).Match(user); got != expected {
+			t.Errorf("%s: expected %v, got %v", src, expected, got)
+		}
+	}
+}
+
+func TestQuerySeenBrowsers(t *testing.T) {
+	user := &User{Browsers: []string{"Android", "MSIE", "Opera"}}
+	q := mustParseQuery(t, `browsers:"Android" and not browsers:"MSIE"`)
+
+	seen := map[string]bool{}
+	if q.match(user, seen) {
+		t.Error("user should not match")
+	}
+	if len(seen) != 2 || !seen["Android"] || !seen["MSIE"] {
+		t.Errorf("browsers of all predicates should be seen, got %v", seen)
+	}
+}
+
+func TestFastSearchQuery(t *testing.T) {
+	slowOut := new(bytes.Buffer)
+	SlowSearch(slowOut)
+
+	fastOut := new(bytes.Buffer)
+	FastSearchQuery(fastOut, mustParseQuery(t, `browsers:"Android" and browsers:"MSIE"`))
+
+	if slowOut.String() != fastOut.String() {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", fastOut, slowOut)
+	}
+}
+
+func TestFastSearchQueryFields(t *testing.T) {
+	out := new(bytes.Buffer)
+	FastSearchQuery(out, mustParseQuery(t, `country:"Dominican Republic" and job:/^Programmer Analyst/`))
+
+	lines := strings.Split(out.String(), "\n")
+	if len(lines) < 5 || !strings.Contains(lines[1], "Sharon Crawford <JonathanMorris [at] Muxo.edu>") {
+		t.Errorf("unexpected result:\n%s", out)
+	}
+	if !strings.HasSuffix(out.String(), "\nTotal unique browsers 0\n") {
+		t.Errorf("no browsers should be seen without browser predicates:\n%s", out)
+	}
+}
+
+func mustParseQuery(t testing.TB, src string) *Query {
+	q, err := ParseQuery(src)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return q
+}
+
+func BenchmarkQuery(b *testing.B) {
+	q := mustParseQuery(b, `browsers:"Android" and (country:"Russia" or not job:/^Senior/)`)
+	for i := 0; i < b.N; i++ {
+		FastSearchQuery(ioutil.Discard, q)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// browserFamilies are checked in order, a browser belongs to the first family
+// with any of its markers, e.g. Chrome pretends to be Safari and Edge pretends to be Chrome
+var browserFamilies = []struct {
+	name    string
+	markers [][]byte
+}{
+	{"Edge", [][]byte{[]byte("Edge/"), []byte("Edg/")}},
+	{"Opera", [][]byte{[]byte("Opera"), []byte("OPR/")}},
+	{"MSIE", [][]byte{[]byte("MSIE"), []byte("Trident/")}},
+	{"Firefox", [][]byte{[]byte("Firefox"), []byte("FxiOS/")}},
+	{"Chrome", [][]byte{[]byte("Chrome/"), []byte("CriOS/")}},
+	{"Android", [][]byte{[]byte("Android")}},
+	{"Safari", [][]byte{[]byte("Safari/")}},
+}
+
+const otherFamily = "Other"
+
+// browserFamily returns the index of the browser family, len(browserFamilies) for other browsers
+func browserFamily(browser []byte) int {
+	for i, family := range browserFamilies {
+		for _, marker := range family.markers {
+			if bytes.Contains(browser, marker) {
+				return i
+			}
+		}
+	}
+	return len(browserFamilies)
+}
+
+func familyName(i int) string {
+	if i == len(browserFamilies) {
+		return otherFamily
+	}
+	return browserFamilies[i].name
+}
+
+// Count is the number of users with something
+type Count struct {
+	Name  string `json:"name"`
+	Users int    `json:"users"`
+}
+
+// Pair is the number of users with browsers of both families
+type Pair struct {
+	A     string `json:"a"`
+	B     string `json:"b"`
+	Users int    `json:"users"`
+}
+
+// Report is a summary of users, every user is counted once for each thing they have
+type Report struct {
+	Users          int     `json:"users"`
+	UniqueBrowsers int     `json:"unique_browsers"`
+	Browsers       []Count `json:"browsers"`
+	Families       []Count `json:"families"`
+	Countries      []Count `json:"countries"`
+	Companies      []Count `json:"companies"`
+	FamilyPairs    []Pair  `json:"family_pairs"`
+}
+
+type reportOptions struct {
+	top    int
+	filter *Query
+}
+
+type ReportOption func(*reportOptions)
+
+// WithTop keeps only n most popular browsers, countries and companies, 10 by default.
+// All of them are kept if n is not positive.
+func WithTop(n int) ReportOption {
+	return func(o *reportOptions) {
+		o.top = n
+	}
+}
+
+// WithFilter counts only users matching the query
+func WithFilter(q *Query) ReportOption {
+	return func(o *reportOptions) {
+		o.filter = q
+	}
+}
+
+// Aggregate makes a report of users read from r in one pass,
+// the input may be compressed with gzip or zstd
+func Aggregate(r io.Reader, opts ...ReportOption) (*Report, error) {
+	o := &reportOptions{top: 10}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	in, err := decompress(r)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	fields := FieldBrowsers.mask() | FieldCountry.mask() | FieldCompany.mask()
+	if o.filter != nil {
+		fields |= o.filter.fields
+	}
+	scanner := &userScanner{fields: fields}
+	agg := newAggregator()
+
+	_, err = scanLines(in, true, func(i int, line []byte) error {
+		if err := scanner.scan(line); err != nil {
+			return &LineError{Line: i + 1, Err: err}
+		}
+		if o.filter == nil || o.filter.matchScanned(scanner, nil) {
+			agg.add(scanner)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return agg.report(o.top), nil
+}
+
+// AggregateFile is Aggregate over the file at path
+func AggregateFile(path string, opts ...ReportOption) (*Report, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return Aggregate(file, opts...)
+}
+
+// counter counts users by name, the pointers let it count names given as bytes
+// without making strings of names met before
+type counter map[string]*int
+
+func (c counter) add(name []byte) {
+	if n := c[string(name)]; n != nil {
+		*n++
+		return
+	}
+	n := 1
+	c[string(name)] = &n
+}
+
+// top returns n largest counts, the most popular first and names in order for the same counts
+func (c counter) top(n int) []Count {
+	counts := make([]Count, 0, len(c))
+	for name, users := range c {
+		counts = append(counts, Count{Name: name, Users: *users})
+	}
+	sortCounts(counts)
+	if n > 0 && len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+func sortCounts(counts []Count) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Users != counts[j].Users {
+			return counts[i].Users > counts[j].Users
+		}
+		return counts[i].Name < counts[j].Name
+	})
+}
+
+type aggregator struct {
+	users     int
+	browsers  counter
+	countries counter
+	companies counter
+	families  []int
+	// pairs[a][b] for a < b is the number of users with both families
+	pairs [][]int
+}
+
+func newAggregator() *aggregator {
+	families := len(browserFamilies) + 1
+	a := &aggregator{
+		browsers:  counter{},
+		countries: counter{},
+		companies: counter{},
+		families:  make([]int, families),
+		pairs:     make([][]int, families),
+	}
+	for i := range a.pairs {
+		a.pairs[i] = make([]int, families)
+	}
+	return a
+}
+
+func (a *aggregator) add(s *userScanner) {
+	a.users++
+	if country := s.field(FieldCountry); len(country) > 0 {
+		a.countries.add(country)
+	}
+	if company := s.field(FieldCompany); len(company) > 0 {
+		a.companies.add(company)
+	}
+
+	var families uint64
+	for i, browser := range s.browsers {
+		families |= 1 << uint(browserFamily(browser))
+		if !seenBefore(s.browsers[:i], browser) {
+			a.browsers.add(browser)
+		}
+	}
+
+	for f := range a.families {
+		if families&(1<<uint(f)) == 0 {
+			continue
+		}
+		a.families[f]++
+		for g := f + 1; g < len(a.families); g++ {
+			if families&(1<<uint(g)) != 0 {
+				a.pairs[f][g]++
+			}
+		}
+	}
+}
+
+// seenBefore tells whether a user has listed the browser already
+func seenBefore(browsers [][]byte, browser []byte) bool {
+	for _, b := range browsers {
+		if bytes.Equal(b, browser) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *aggregator) report(top int) *Report {
+	r := &Report{
+		Users:          a.users,
+		UniqueBrowsers: len(a.browsers),
+		Browsers:       a.browsers.top(top),
+		Countries:      a.countries.top(top),
+		Companies:      a.companies.top(top),
+		Families:       []Count{},
+		FamilyPairs:    []Pair{},
+	}
+
+	for f, users := range a.families {
+		if users > 0 {
+			r.Families = append(r.Families, Count{Name: familyName(f), Users: users})
+		}
+		for g, users := range a.pairs[f] {
+			if users > 0 {
+				r.FamilyPairs = append(r.FamilyPairs, Pair{A: familyName(f), B: familyName(g), Users: users})
+			}
+		}
+	}
+	sortCounts(r.Families)
+	sort.SliceStable(r.FamilyPairs, func(i, j int) bool {
+		return r.FamilyPairs[i].Users > r.FamilyPairs[j].Users
+	})
+	return r
+}
+
+// WriteText writes the report as a few tables of text
+func (r *Report) WriteText(w io.Writer) error {
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "Users %d\nUnique browsers %d\n", r.Users, r.UniqueBrowsers)
+
+	for _, section := range []struct {
+		title  string
+		counts []Count
+	}{
+		{"Top browsers", r.Browsers},
+		{"Browser families", r.Families},
+		{"Countries", r.Countries},
+		{"Companies", r.Companies},
+	} {
+		fmt.Fprintf(b, "\n%s:\n", section.title)
+		for _, c := range section.counts {
+			fmt.Fprintf(b, "%6d %s\n", c.Users, c.Name)
+		}
+	}
+
+	fmt.Fprintf(b, "\nBrowser families used together:\n")
+	for _, p := range r.FamilyPairs {
+		fmt.Fprintf(b, "%6d %s + %s\n", p.Users, p.A, p.B)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBrowserFamily(t *testing.T) {
+	for browser, family := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/42.0.2311.135 Safari/537.36 Edge/12.10240": "Edge",
+		"Opera/9.80 (S60; SymbOS; Opera Mobi/499; U; ru) Presto/2.4.18 Version/10.00":                                           "Opera",
+		"Mozilla/4.0 (compatible; MSIE 6.0; Windows CE; IEMobile 7.11) Sprint:PPC6800":                                          "MSIE",
+		"Mozilla/5.0 (Windows Phone 8.1; ARM; Trident/7.0; Touch; rv:11.0; IEMobile/11.0; NOKIA; Lumia 630) like Gecko":         "MSIE",
+		"Mozilla/5.0 (Android; Linux armv7l; rv:10.0.1) Gecko/20100101 Firefox/10.0.1 Fennec/10.0.1":                            "Firefox",
+		"Mozilla/5.0 (Linux; Android 6.0; LG-D850 Build/MRA58K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/53.0.2785.97":     "Chrome",
+		"Mozilla/5.0 (Linux; U; Android 4.0.3; de-ch) AppleWebKit/534.30 (KHTML, like Gecko) Version/4.0 Mobile Safari/534.30":  "Android",
+		"Mozilla/5.0 (iPad; CPU OS 8_4_1 like Mac OS X) AppleWebKit/600.1.4 (KHTML, like Gecko) Version/8.0 Safari/600.1.4":     "Safari",
+		"ELinks (0.4pre5; Linux 2.6.10-ac7 i686; 80x33)":                                                                        "Other",
+	} {
+		if got := familyName(browserFamily([]byte(browser))); got != family {
+			t.Errorf("%s: expected %s, got %s", browser, family, got)
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	users := `{"browsers":["Opera/9.80","Chrome/53 Safari/537","Opera/9.80"],"country":"Russia","company":"Yandex"}
+{"browsers":["MSIE 6.0","Chrome/53 Safari/537"],"country":"Russia","company":"Mail"}
+{"browsers":["Links"],"country":"Chile","company":"Yandex","email":"x@y"}
+{"browsers":[],"country":"","company":"Mail"}
+`
+	report, err := Aggregate(strings.NewReader(users), WithTop(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Report{
+		Users:          4,
+		UniqueBrowsers: 4,
+		Browsers:       []Count{{"Chrome/53 Safari/537", 2}},
+		Families:       []Count{{"Chrome", 2}, {"MSIE", 1}, {"Opera", 1}, {"Other", 1}},
+		Countries:      []Count{{"Russia", 2}},
+		Companies:      []Count{{"Mail", 2}},
+		FamilyPairs:    []Pair{{"Opera", "Chrome", 1}, {"MSIE", "Chrome", 1}},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Errorf("expected\n%+v\ngot\n%+v", expected, report)
+	}
+
+	report, err = Aggregate(strings.NewReader(users), WithTop(0), WithFilter(mustParseQuery(t, `company:"Yandex"`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != 2 || len(report.Browsers) != 3 || len(report.Countries) != 2 {
+		t.Errorf("unexpected report of Yandex users %+v", report)
+	}
+
+	out := new(bytes.Buffer)
+	if err := report.WriteText(out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"Users 2\n", "\nTop browsers:\n     1 Chrome/53 Safari/537\n     1 Links\n", "     1 Opera + Chrome\n"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("no %q in\n%s", line, out)
+		}
+	}
+}
+
+func TestAggregateFile(t *testing.T) {
+	report, err := AggregateFile(filePath, WithTop(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	browsers := map[string]bool{}
+	userBrowsers := 0
+	lines := bytes.Split(readUsers(t), []byte("\n"))
+	for _, line := range lines {
+		var user User
+		if err := json.Unmarshal(line, &user); err != nil {
+			t.Fatal(err)
+		}
+		distinct := map[string]bool{}
+		for _, browser := range user.Browsers {
+			browsers[browser] = true
+			distinct[browser] = true
+		}
+		userBrowsers += len(distinct)
+	}
+
+	if report.Users != len(lines) || report.UniqueBrowsers != len(browsers) || len(report.Browsers) != len(browsers) {
+		t.Errorf("expected %d users with %d browsers, got %d with %d", len(lines), len(browsers), report.Users, report.UniqueBrowsers)
+	}
+	sum := 0
+	for _, c := range report.Browsers {
+		sum += c.Users
+	}
+	if sum != userBrowsers {
+		t.Errorf("expected %d browsers of users, got %d", userBrowsers, sum)
+	}
+
+	found := new(bytes.Buffer)
+	FastSearch(found)
+	report, err = AggregateFile(filePath, WithFilter(androidAndMSIE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if users := strings.Count(found.String(), " [at] "); report.Users != users {
+		t.Errorf("expected %d Android and MSIE users, got %d", users, report.Users)
+	}
+}
+
+func BenchmarkAggregate(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := AggregateFile(filePath); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
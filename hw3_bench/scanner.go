@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// userScanner extracts fields of a user line without allocations, unlike the easyjson decoder
+// which makes strings of them. Values are slices of the line: strings with escapes are unescaped
+// in place, so the line is changed and values are valid as long as the line is.
+type userScanner struct {
+	// fields are the fields to extract, others are skipped
+	fields   fieldMask
+	browsers [][]byte
+	values   [FieldEmail + 1][]byte
+
+	data []byte
+	pos  int
+}
+
+var errUnexpectedEnd = errors.New("unexpected end of line")
+
+func (s *userScanner) errorf(format string, args ...interface{}) error {
+	if s.pos >= len(s.data) {
+		return errUnexpectedEnd
+	}
+	return fmt.Errorf("%s at %d", fmt.Sprintf(format, args...), s.pos)
+}
+
+// field returns the value of a string field
+func (s *userScanner) field(f Field) []byte {
+	return s.values[f]
+}
+
+// user fills u with the extracted fields
+func (s *userScanner) user(u *User) {
+	u.Browsers = u.Browsers[:0]
+	for _, browser := range s.browsers {
+		u.Browsers = append(u.Browsers, string(browser))
+	}
+	u.Country = string(s.values[FieldCountry])
+	u.Company = string(s.values[FieldCompany])
+	u.Job = string(s.values[FieldJob])
+	u.Name = string(s.values[FieldName])
+	u.Email = string(s.values[FieldEmail])
+}
+
+// scan extracts fields of the JSON object in the line
+func (s *userScanner) scan(line []byte) error {
+	s.data, s.pos = line, 0
+	s.browsers = s.browsers[:0]
+	for i := range s.values {
+		s.values[i] = nil
+	}
+
+	if s.skipSpace(); s.literal("null") {
+		return s.end()
+	}
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+	if s.skipSpace(); s.pos < len(s.data) && s.data[s.pos] == '}' {
+		s.pos++
+		return s.end()
+	}
+
+	for {
+		s.skipSpace()
+		key, err := s.string()
+		if err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		s.skipSpace()
+
+		switch f := keyField(key); {
+		case f < 0 || s.fields&f.mask() == 0:
+			err = s.skipValue()
+		case s.literal("null"):
+			if f == FieldBrowsers {
+				s.browsers = s.browsers[:0]
+			} else {
+				s.values[f] = nil
+			}
+		case f == FieldBrowsers:
+			err = s.scanBrowsers()
+		default:
+			s.values[f], err = s.string()
+		}
+		if err != nil {
+			return err
+		}
+
+		s.skipSpace()
+		if s.pos >= len(s.data) {
+			return errUnexpectedEnd
+		}
+		if s.data[s.pos] == '}' {
+			s.pos++
+			return s.end()
+		}
+		if err := s.expect(','); err != nil {
+			return err
+		}
+	}
+}
+
+func keyField(key []byte) Field {
+	switch string(key) {
+	case "browsers":
+		return FieldBrowsers
+	case "country":
+		return FieldCountry
+	case "company":
+		return FieldCompany
+	case "job":
+		return FieldJob
+	case "name":
+		return FieldName
+	case "email":
+		return FieldEmail
+	}
+	return -1
+}
+
+// end makes sure only spaces follow the object
+func (s *userScanner) end() error {
+	if s.skipSpace(); s.pos < len(s.data) {
+		return s.errorf("unexpected %q", s.data[s.pos])
+	}
+	return nil
+}
+
+func (s *userScanner) scanBrowsers() error {
+	s.browsers = s.browsers[:0]
+	if err := s.expect('['); err != nil {
+		return err
+	}
+	if s.skipSpace(); s.pos < len(s.data) && s.data[s.pos] == ']' {
+		s.pos++
+		return nil
+	}
+
+	for {
+		s.skipSpace()
+		browser, err := s.string()
+		if err != nil {
+			return err
+		}
+		s.browsers = append(s.browsers, browser)
+
+		s.skipSpace()
+		if s.pos < len(s.data) && s.data[s.pos] == ']' {
+			s.pos++
+			return nil
+		}
+		if err := s.expect(','); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *userScanner) skipSpace() {
+	for s.pos < len(s.data) {
+		switch s.data[s.pos] {
+		case ' ', '\t', '\r', '\n':
+			s.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (s *userScanner) expect(c byte) error {
+	s.skipSpace()
+	if s.pos >= len(s.data) || s.data[s.pos] != c {
+		return s.errorf("expected %q", c)
+	}
+	s.pos++
+	return nil
+}
+
+// literal consumes the word if it comes next
+func (s *userScanner) literal(word string) bool {
+	if len(s.data)-s.pos < len(word) || string(s.data[s.pos:s.pos+len(word)]) != word {
+		return false
+	}
+	s.pos += len(word)
+	return true
+}
+
+// string reads a JSON string and returns its unescaped value
+func (s *userScanner) string() ([]byte, error) {
+	if s.pos >= len(s.data) || s.data[s.pos] != '"' {
+		return nil, s.errorf("expected a string")
+	}
+	s.pos++
+	start := s.pos
+
+	end := bytes.IndexByte(s.data[start:], '"')
+	if end < 0 {
+		return nil, errUnexpectedEnd
+	}
+	if k := bytes.IndexByte(s.data[start:start+end], '\\'); k >= 0 {
+		s.pos += k
+		return s.unescape(start)
+	}
+	s.pos += end + 1
+	return s.data[start : start+end], nil
+}
+
+// unescape continues reading the string from the first backslash,
+// the value is written over the string as escapes are longer than what they stand for
+func (s *userScanner) unescape(start int) ([]byte, error) {
+	w := s.pos
+	for s.pos < len(s.data) {
+		c := s.data[s.pos]
+		switch {
+		case c == '"':
+			s.pos++
+			return s.data[start:w], nil
+		case c != '\\':
+			s.data[w] = c
+			w++
+			s.pos++
+			continue
+		}
+
+		if s.pos+1 >= len(s.data) {
+			return nil, errUnexpectedEnd
+		}
+		s.pos += 2
+		switch c := s.data[s.pos-1]; c {
+		case '"', '\\', '/':
+			s.data[w] = c
+		case 'b':
+			s.data[w] = '\b'
+		case 'f':
+			s.data[w] = '\f'
+		case 'n':
+			s.data[w] = '\n'
+		case 'r':
+			s.data[w] = '\r'
+		case 't':
+			s.data[w] = '\t'
+		case 'u':
+			r, ok := s.hex4()
+			if !ok {
+				return nil, s.errorf("bad unicode escape")
+			}
+			if utf16.IsSurrogate(r) {
+				// the second half of a pair must follow, otherwise it is a broken character
+				pair := utf8.RuneError
+				if next := s.pos; s.pos+1 < len(s.data) && s.data[s.pos] == '\\' && s.data[s.pos+1] == 'u' {
+					s.pos += 2
+					if r2, ok := s.hex4(); ok {
+						pair = utf16.DecodeRune(r, r2)
+					}
+					if pair == utf8.RuneError {
+						s.pos = next
+					}
+				}
+				r = pair
+			}
+			w += utf8.EncodeRune(s.data[w:], r)
+			continue
+		default:
+			return nil, s.errorf("bad escape \\%c", c)
+		}
+		w++
+	}
+	return nil, errUnexpectedEnd
+}
+
+func (s *userScanner) hex4() (rune, bool) {
+	if len(s.data)-s.pos < 4 {
+		return 0, false
+	}
+	var r rune
+	for _, c := range s.data[s.pos : s.pos+4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c -= 'a' - 10
+		case c >= 'A' && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	s.pos += 4
+	return r, true
+}
+
+// skipValue skips a value of a field nobody needs
+func (s *userScanner) skipValue() error {
+	if s.pos >= len(s.data) {
+		return errUnexpectedEnd
+	}
+
+	switch c := s.data[s.pos]; {
+	case c == '"':
+		start := s.pos + 1
+		for s.pos = start; ; {
+			k := bytes.IndexByte(s.data[s.pos:], '"')
+			if k < 0 {
+				return errUnexpectedEnd
+			}
+			s.pos += k + 1
+			// the quote is escaped if it follows an odd number of backslashes
+			backslashes := 0
+			for j := s.pos - 2; j >= start && s.data[j] == '\\'; j-- {
+				backslashes++
+			}
+			if backslashes%2 == 0 {
+				return nil
+			}
+		}
+
+	case c == '{' || c == '[':
+		end := byte('}')
+		if c == '[' {
+			end = ']'
+		}
+		s.pos++
+		if s.skipSpace(); s.pos < len(s.data) && s.data[s.pos] == end {
+			s.pos++
+			return nil
+		}
+		for {
+			s.skipSpace()
+			if c == '{' {
+				if _, err := s.string(); err != nil {
+					return err
+				}
+				if err := s.expect(':'); err != nil {
+					return err
+				}
+				s.skipSpace()
+			}
+			if err := s.skipValue(); err != nil {
+				return err
+			}
+			s.skipSpace()
+			if s.pos < len(s.data) && s.data[s.pos] == end {
+				s.pos++
+				return nil
+			}
+			if err := s.expect(','); err != nil {
+				return err
+			}
+		}
+
+	case c == '-' || c >= '0' && c <= '9':
+		start := s.pos
+		for s.pos < len(s.data) && isNumberByte(s.data[s.pos]) {
+			s.pos++
+		}
+		if s.pos == start+1 && c == '-' {
+			return s.errorf("bad number")
+		}
+		return nil
+	}
+
+	if s.literal("true") || s.literal("false") || s.literal("null") {
+		return nil
+	}
+	return s.errorf("unexpected %q", s.data[s.pos])
+}
+
+func isNumberByte(c byte) bool {
+	return c >= '0' && c <= '9' || c == '-' || c == '+' || c == '.' || c == 'e' || c == 'E'
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	jlexer "github.com/mailru/easyjson/jlexer"
+)
+
+var scannerLines = []string{
+	`{}`,
+	`null`,
+	` { "name" : "Ivan" , "browsers" : [ ] } `,
+	`{"browsers":null,"name":null,"email":"a@b"}`,
+	`{"name":"Tab\there \"quoted\" back\\slash \/ \u00e9\u4e16 \ud83d\ude00 \ud800x","email":"\u0040"}`,
+	`{"phone":{"nested":[1,-2.5e3,true,false,null,{"a":"}"}],"b":"\"]"},"browsers":["A","B\nC"],"job":"x"}`,
+	`{"browsers":["first"],"browsers":["second","third"],"name":"dup"}`,
+	`{"Name":"case matters","email":"e"}`,
+	`{"phone":"ends with \\","name":"after a backslash","company":"\\\"q\\"}`,
+}
+
+func easyjsonUser(t *testing.T, line []byte, fields fieldMask) User {
+	var u User
+	in := jlexer.Lexer{Data: line}
+	decodeUser(&in, &u, fields)
+	if err := in.Error(); err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	return u
+}
+
+func scannedUser(t *testing.T, line []byte, fields fieldMask) User {
+	var u User
+	s := &userScanner{fields: fields}
+	// the scanner changes the line
+	if err := s.scan(append([]byte(nil), line...)); err != nil {
+		t.Fatalf("%s: %v", line, err)
+	}
+	s.user(&u)
+	return u
+}
+
+func sameUsers(a, b User) bool {
+	if len(a.Browsers) == 0 && len(b.Browsers) == 0 {
+		a.Browsers, b.Browsers = nil, nil
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func TestScannerMatchesEasyjson(t *testing.T) {
+	lines := bytes.Split(readUsers(t), []byte("\n"))
+	for _, line := range scannerLines {
+		lines = append(lines, []byte(line))
+	}
+
+	for _, fields := range []fieldMask{^fieldMask(0), outputFields, FieldBrowsers.mask() | FieldJob.mask()} {
+		for _, line := range lines {
+			expected := easyjsonUser(t, line, ^fieldMask(0))
+			got := scannedUser(t, line, fields)
+			for f := FieldCountry; f <= FieldEmail; f++ {
+				if fields&f.mask() == 0 && got.field(f) != "" {
+					t.Errorf("%s: unexpected %v %q", line, f, got.field(f))
+				}
+			}
+			if fields != ^fieldMask(0) {
+				continue
+			}
+			if !sameUsers(got, expected) {
+				t.Errorf("%s:\nexpected %#v\ngot      %#v", line, expected, got)
+			}
+		}
+	}
+}
+
+func TestScannerErrors(t *testing.T) {
+	for _, line := range []string{
+		``,
+		`{`,
+		`[]`,
+		`{"name"}`,
+		`{"name":"a",}`,
+		`{"name":"a"} x`,
+		`{"name":"a" "email":"b"}`,
+		`{"name":5}`,
+		`{"browsers":"MSIE"}`,
+		`{"browsers":["MSIE",]}`,
+		`{"browsers":["MSIE" "Android"]}`,
+		`{"name":"a\qb"}`,
+		`{"name":"a\u00zz"}`,
+		`{"name":"a`,
+		`{"phone":[1,}`,
+		`{"phone":tru}`,
+		`{"phone":-}`,
+	} {
+		s := &userScanner{fields: ^fieldMask(0)}
+		if err := s.scan([]byte(line)); err == nil {
+			t.Errorf("%s: expected an error", line)
+		}
+	}
+}
+
+func TestScannerAllocs(t *testing.T) {
+	lines := bytes.Split(readUsers(t), []byte("\n"))
+	s := &userScanner{fields: outputFields}
+	var buf []byte
+
+	allocs := testing.AllocsPerRun(10, func() {
+		for _, line := range lines {
+			buf = append(buf[:0], line...)
+			if err := s.scan(buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+// go test -bench Decode -benchmem
+func BenchmarkDecodeEasyjson(b *testing.B) {
+	lines := bytes.Split(readUsers(b), []byte("\n"))
+	var user User
+	var buf []byte
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			// the same copy as for the scanner
+			buf = append(buf[:0], line...)
+			user = User{Browsers: user.Browsers[:0]}
+			in := jlexer.Lexer{Data: buf}
+			decodeUser(&in, &user, outputFields)
+		}
+	}
+}
+
+func BenchmarkDecodeScanner(b *testing.B) {
+	lines := bytes.Split(readUsers(b), []byte("\n"))
+	s := &userScanner{fields: outputFields}
+	var buf []byte
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			buf = append(buf[:0], line...)
+			s.scan(buf)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+type searchOptions struct {
+	query    *Query
+	workers  int
+	format   Format
+	fields   []Field
+	rawEmail bool
+	lenient  bool
+	report   *Malformed
+	// skipUnterminated drops the last line without a newline, only FastSearch does it
+	skipUnterminated bool
+}
+
+type SearchOption func(*searchOptions)
+
+// WithQuery sets what to search for, users with Android and MSIE browsers by default
+func WithQuery(q *Query) SearchOption {
+	return func(o *searchOptions) {
+		o.query = q
+	}
+}
+
+// WithWorkers makes SearchFile scan the file on several goroutines, a goroutine per CPU
+// if n is not positive. Compressed files and readers are always scanned on one goroutine.
+func WithWorkers(n int) SearchOption {
+	return func(o *searchOptions) {
+		o.workers = n
+	}
+}
+
+// WithLenient skips lines which can't be parsed instead of failing, the output ends
+// with the count and numbers of skipped lines, which count from 1 like in LineError
+func WithLenient() SearchOption {
+	return func(o *searchOptions) {
+		o.lenient = true
+	}
+}
+
+// WithMalformedReport is WithLenient which also stores the report of skipped lines in m.
+// JSON and CSV have only found users, so it is how to get the report with them.
+func WithMalformedReport(m *Malformed) SearchOption {
+	return func(o *searchOptions) {
+		o.lenient = true
+		o.report = m
+	}
+}
+
+func withoutUnterminated() SearchOption {
+	return func(o *searchOptions) {
+		o.skipUnterminated = true
+	}
+}
+
+// newMalformed returns the report of skipped lines, nil if they are errors
+func (o *searchOptions) newMalformed() *Malformed {
+	if !o.lenient {
+		return nil
+	}
+	return &Malformed{}
+}
+
+// reportMalformed stores the report of the whole input for WithMalformedReport
+func (o *searchOptions) reportMalformed(malformed *Malformed) {
+	if o.report != nil && malformed != nil {
+		*o.report = *malformed
+	}
+}
+
+func newSearchOptions(opts []SearchOption) (*searchOptions, error) {
+	o := &searchOptions{
+		query:   androidAndMSIE,
+		workers: 1,
+		fields:  []Field{FieldName, FieldEmail},
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.format < FormatText || o.format > FormatCSV {
+		return nil, fmt.Errorf("unknown format %d", o.format)
+	}
+	for _, f := range o.fields {
+		if f < FieldBrowsers || f > FieldEmail {
+			return nil, fmt.Errorf("unknown field %v", f)
+		}
+	}
+	return o, nil
+}
+
+// Search is FastSearch over users read from r, which may be compressed with gzip or zstd.
+// Unlike FastSearch it reads the last line without a newline, a line cut short is an error.
+func Search(out io.Writer, r io.Reader, opts ...SearchOption) error {
+	o, err := newSearchOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	return searchReader(out, r, o)
+}
+
+func searchReader(out io.Writer, r io.Reader, o *searchOptions) error {
+	in, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return fastSearch(out, in, o)
+}
+
+// SearchFile is Search over the file at path
+func SearchFile(out io.Writer, path string, opts ...SearchOption) error {
+	o, err := newSearchOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if o.workers != 1 {
+		head := make([]byte, len(zstdMagic))
+		n, err := file.ReadAt(head, 0)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !compressed(head[:n]) {
+			info, err := file.Stat()
+			if err != nil {
+				return err
+			}
+			return searchParallel(out, file, info.Size(), o)
+		}
+	}
+
+	return searchReader(out, file, o)
+}
+
+// SlowSearchReader is SlowSearch over users read from r, which may be compressed with gzip or zstd
+func SlowSearchReader(out io.Writer, r io.Reader) error {
+	in, err := decompress(r)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return slowSearch(out, in, false)
+}
+
+func compressed(head []byte) bool {
+	return bytes.HasPrefix(head, gzipMagic) || bytes.HasPrefix(head, zstdMagic)
+}
+
+// decompress recognizes gzip and zstd streams by their magic numbers,
+// other input is returned as is
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return gz, nil
+
+	case bytes.HasPrefix(head, zstdMagic):
+		dec, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+
+	return ioutil.NopCloser(br), nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func readUsers(t testing.TB) []byte {
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	w, err := zstd.NewWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSearchCompressed(t *testing.T) {
+	expected := new(bytes.Buffer)
+	FastSearch(expected)
+
+	data := readUsers(t)
+	for name, input := range map[string][]byte{
+		"plain": data,
+		"gzip":  gzipped(t, data),
+		"zstd":  zstded(t, data),
+	} {
+		out := new(bytes.Buffer)
+		if err := Search(out, bytes.NewReader(input)); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if out.String() != expected.String() {
+			t.Errorf("%s: results not match\nGot:\n%v\nExpected:\n%v", name, out, expected)
+		}
+	}
+}
+
+func TestSearchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "search")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.txt.gz")
+	if err := ioutil.WriteFile(path, gzipped(t, readUsers(t)), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := new(bytes.Buffer)
+	FastSearch(expected)
+
+	for _, workers := range []int{1, 4} {
+		out := new(bytes.Buffer)
+		if err := SearchFile(out, path, WithWorkers(workers)); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != expected.String() {
+			t.Errorf("%d workers: results not match\nGot:\n%v\nExpected:\n%v", workers, out, expected)
+		}
+	}
+
+	if err := SearchFile(ioutil.Discard, filepath.Join(dir, "missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestSlowSearchReader(t *testing.T) {
+	data := readUsers(t)
+
+	expected := new(bytes.Buffer)
+	if err := Search(expected, bytes.NewReader(data), WithQuery(androidAndMSIE)); err != nil {
+		t.Fatal(err)
+	}
+
+	out := new(bytes.Buffer)
+	if err := SlowSearchReader(out, bytes.NewReader(zstded(t, data))); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected.String() {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected)
+	}
+}
+
+func TestSearchLastLine(t *testing.T) {
+	input := `{"browsers":["Android"],"name":"A","email":"a@a"}` + "\n" +
+		`{"browsers":["Android","MSIE"],"name":"B","email":"b@b"}`
+	expected := "found users:\n[1] B <b [at] b>\n\nTotal unique browsers 2\n"
+
+	slow := new(bytes.Buffer)
+	if err := SlowSearchReader(slow, strings.NewReader(input)); err != nil || slow.String() != expected {
+		t.Fatalf("slow: expected\n%s\ngot\n%s%v", expected, slow, err)
+	}
+	out := new(bytes.Buffer)
+	if err := Search(out, strings.NewReader(input)); err != nil || out.String() != expected {
+		t.Errorf("fast: expected\n%s\ngot\n%s%v", expected, out, err)
+	}
+	for _, workers := range []int{2, 7} {
+		out := new(bytes.Buffer)
+		err := searchParallel(out, strings.NewReader(input), int64(len(input)), &searchOptions{query: androidAndMSIE, workers: workers})
+		if err != nil || out.String() != expected {
+			t.Errorf("%d workers: expected\n%s\ngot\n%s%v", workers, expected, out, err)
+		}
+	}
+
+	// a line cut short is an error even at the end
+	truncated := input[:len(input)-10]
+	check := func(name string, err error) {
+		var lineErr *LineError
+		if !errors.As(err, &lineErr) || lineErr.Line != 2 {
+			t.Errorf("%s: expected an error in line 2, got %v", name, err)
+		}
+	}
+	check("fast", Search(ioutil.Discard, strings.NewReader(truncated)))
+	check("slow", SlowSearchReader(ioutil.Discard, strings.NewReader(truncated)))
+	check("parallel", searchParallel(ioutil.Discard, strings.NewReader(truncated), int64(len(truncated)), &searchOptions{query: androidAndMSIE, workers: 2}))
+}
+
+func TestSearchErrors(t *testing.T) {
+	input := strings.Repeat(`{"browsers":["Android"],"name":"A","email":"a@a"}`+"\n", 20) +
+		`{"browsers":["MSIE"],"name":` + "\n" +
+		`{"browsers":["MSIE"],"name":"B","email":"b@b"}` + "\n"
+
+	check := func(name string, err error) {
+		var lineErr *LineError
+		if !errors.As(err, &lineErr) || lineErr.Line != 21 {
+			t.Errorf("%s: expected an error in line 21, got %v", name, err)
+		}
+	}
+	check("fast", Search(ioutil.Discard, strings.NewReader(input)))
+	check("slow", SlowSearchReader(ioutil.Discard, strings.NewReader(input)))
+	check("gzip", Search(ioutil.Discard, bytes.NewReader(gzipped(t, []byte(input)))))
+	for _, workers := range []int{2, 7} {
+		check("parallel", searchParallel(ioutil.Discard, strings.NewReader(input), int64(len(input)), &searchOptions{query: androidAndMSIE, workers: workers}))
+	}
+
+	broken := gzipped(t, []byte(input))
+	err := Search(ioutil.Discard, bytes.NewReader(broken[:len(broken)/2]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("expected unexpected EOF for a truncated gzip stream, got %v", err)
+	}
+}
+
+func TestLenientSearch(t *testing.T) {
+	input := `{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}` + "\n" +
+		`{"browsers":["MSIE"],"name":` + "\n" +
+		"not json\n" +
+		"\n" +
+		`{"browsers":["Android 2","MSIE"],"name":"B","email":"b@b"}` + "\n" +
+		`{"browsers":["Android","MSIE 6"],"name":"C","email":"c@c"}`
+	expected := "found users:\n[0] A <a [at] a>\n[4] B <b [at] b>\n[5] C <c [at] c>\n\n" +
+		"Total unique browsers 4\nMalformed lines 3: 2, 3, 4\n"
+
+	check := func(name string, out *bytes.Buffer, err error) {
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if out.String() != expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", name, expected, out)
+		}
+	}
+	out := new(bytes.Buffer)
+	check("fast", out, Search(out, strings.NewReader(input), WithLenient()))
+	out = new(bytes.Buffer)
+	check("slow", out, slowSearch(out, strings.NewReader(input), true))
+	out = new(bytes.Buffer)
+	check("gzip", out, Search(out, bytes.NewReader(gzipped(t, []byte(input))), WithLenient()))
+	for _, workers := range []int{2, 7} {
+		out = new(bytes.Buffer)
+		check("parallel", out, searchParallel(out, strings.NewReader(input), int64(len(input)), &searchOptions{query: androidAndMSIE, workers: workers, lenient: true}))
+	}
+}
+
+func TestLenientSearchFile(t *testing.T) {
+	// both read the last line, which has no newline
+	expected := new(bytes.Buffer)
+	SlowSearchLenient(expected)
+	out := new(bytes.Buffer)
+	FastSearchLenient(out)
+	if out.String() != expected.String() || !strings.HasSuffix(out.String(), "\nMalformed lines 0\n") {
+		t.Errorf("results not match\nGot:\n%v\nExpected:\n%v", out, expected)
+	}
+}
+
+func TestManyMalformedLines(t *testing.T) {
+	input := strings.Repeat(`{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}`+"\n"+"{\n", 150)
+	numbers := make([]string, maxMalformedLines)
+	for i := range numbers {
+		numbers[i] = strconv.Itoa(2*i + 2)
+	}
+	expected := "Malformed lines 150: " + strings.Join(numbers, ", ") + " and 50 more\n"
+
+	for _, workers := range []int{1, 3, 8} {
+		out := new(bytes.Buffer)
+		report := &Malformed{}
+		if err := searchParallel(out, strings.NewReader(input), int64(len(input)), &searchOptions{query: androidAndMSIE, workers: workers, lenient: true, report: report}); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(out.String(), "\nTotal unique browsers 2\n"+expected) {
+			t.Errorf("%d workers: expected the output to end with\n%s\ngot\n%s", workers, expected, out.String()[len(out.String())-200:])
+		}
+		if report.String()+"\n" != expected {
+			t.Errorf("%d workers: the report differs from the output: %s", workers, report)
+		}
+	}
+}
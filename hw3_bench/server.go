@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 1000
+)
+
+// Server answers queries over a users file over HTTP:
+//
+//	GET /search?q=...&format=text|json|csv&fields=name,email&raw_email=1&lenient=1  found users as Search writes them
+//	GET /users?q=...&offset=0&limit=20&fields=...&raw_email=1&lenient=1             a page of found users as JSON
+//	GET /report?q=...&top=10&format=json|text                                       a Report of users matching q
+//	GET /stats                                                                      what is loaded
+//
+// Lenient searches tell the count and numbers of skipped lines in X-Malformed-Count
+// and X-Malformed-Lines headers, the body of /search has them only in the text format.
+//
+// The file is read once and read again when it changes.
+type Server struct {
+	path string
+	// checkEvery is how often requests look whether the file has changed
+	checkEvery time.Duration
+	mux        *http.ServeMux
+	load       func(path string) (*dataset, error)
+
+	// data is the current *dataset, requests take it without waiting for a reload
+	data atomic.Value
+
+	mu        sync.Mutex
+	checked   time.Time
+	reloading bool
+	loadErr   error
+}
+
+// dataset is the content of the users file, it doesn't change
+type dataset struct {
+	users   []byte
+	size    int64
+	modTime time.Time
+	loaded  time.Time
+}
+
+type ServerOption func(*Server)
+
+// WithCheckInterval sets how often the server looks whether the file has changed,
+// every request does if d is 0. It is a second by default.
+func WithCheckInterval(d time.Duration) ServerOption {
+	return func(s *Server) {
+		s.checkEvery = d
+	}
+}
+
+// NewServer loads the users file at path, which may be compressed with gzip or zstd
+func NewServer(path string, opts ...ServerOption) (*Server, error) {
+	s := &Server{path: path, checkEvery: time.Second, mux: http.NewServeMux(), load: loadDataset}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	data, err := s.load(path)
+	if err != nil {
+		return nil, err
+	}
+	s.data.Store(data)
+	s.checked = time.Now()
+
+	s.mux.HandleFunc("/search", s.handleSearch)
+	s.mux.HandleFunc("/users", s.handleUsers)
+	s.mux.HandleFunc("/report", s.handleReport)
+	s.mux.HandleFunc("/stats", s.handleStats)
+	return s, nil
+}
+
+func loadDataset(path string) (*dataset, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	in, err := decompress(file)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	users, err := ioutil.ReadAll(in)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dataset{users: users, size: info.Size(), modTime: info.ModTime(), loaded: time.Now()}, nil
+}
+
+// dataset returns the users, loading them again if the file has changed.
+// Only one request reloads the file, the others get the old users meanwhile.
+// If it can't be loaded, the old users are kept and the error is shown in stats.
+func (s *Server) dataset() *dataset {
+	data := s.data.Load().(*dataset)
+
+	s.mu.Lock()
+	if s.reloading || time.Since(s.checked) < s.checkEvery {
+		s.mu.Unlock()
+		return data
+	}
+	s.checked, s.reloading = time.Now(), true
+	s.mu.Unlock()
+
+	data, err := s.reload(data)
+
+	s.mu.Lock()
+	s.reloading, s.loadErr = false, err
+	s.mu.Unlock()
+	return data
+}
+
+// reload loads the file if it differs from data and returns the current users
+func (s *Server) reload(data *dataset) (*dataset, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return data, err
+	}
+	if info.Size() == data.size && info.ModTime().Equal(data.modTime) {
+		return data, nil
+	}
+
+	loaded, err := s.load(s.path)
+	if err != nil {
+		return data, err
+	}
+	s.data.Store(loaded)
+	return loaded, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// queryParam parses the q parameter, FastSearch query if there is none
+func queryParam(r *http.Request) (*Query, error) {
+	src := r.FormValue("q")
+	if src == "" {
+		return androidAndMSIE, nil
+	}
+	return ParseQuery(src)
+}
+
+// searchParams makes search options of request parameters
+func searchParams(r *http.Request) ([]SearchOption, error) {
+	q, err := queryParam(r)
+	if err != nil {
+		return nil, err
+	}
+	opts := []SearchOption{WithQuery(q)}
+
+	if names := r.FormValue("fields"); names != "" {
+		var fields []Field
+		for _, name := range strings.Split(names, ",") {
+			f, ok := fieldNames[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown field %q", name)
+			}
+			fields = append(fields, f)
+		}
+		opts = append(opts, WithFields(fields...))
+	}
+
+	for name, opt := range map[string]SearchOption{"raw_email": WithRawEmail(), "lenient": WithLenient()} {
+		if value := r.FormValue(name); value != "" {
+			ok, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("bad %s: %v", name, err)
+			}
+			if ok {
+				opts = append(opts, opt)
+			}
+		}
+	}
+	return opts, nil
+}
+
+func intParam(r *http.Request, name string, def int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad %s %q", name, value)
+	}
+	return n, nil
+}
+
+var formats = map[string]struct {
+	format      Format
+	contentType string
+}{
+	"text": {FormatText, "text/plain; charset=utf-8"},
+	"json": {FormatJSON, "application/x-ndjson"},
+	"csv":  {FormatCSV, "text/csv; charset=utf-8"},
+}
+
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	opts, err := searchParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.FormValue("format")
+	if name == "" {
+		name = "text"
+	}
+	format, ok := formats[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown format %q", name), http.StatusBadRequest)
+		return
+	}
+
+	// searchParams has checked the value
+	var malformed *Malformed
+	if lenient, _ := strconv.ParseBool(r.FormValue("lenient")); lenient {
+		malformed = &Malformed{}
+		opts = append(opts, WithMalformedReport(malformed))
+	}
+
+	// the response is buffered, so an error can still be reported with its status
+	// and the malformed lines in headers
+	out := &bytes.Buffer{}
+	if err := Search(out, bytes.NewReader(s.dataset().users), append(opts, WithFormat(format.format))...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", format.contentType)
+	if malformed != nil {
+		lines := make([]string, len(malformed.Lines))
+		for i, line := range malformed.Lines {
+			lines[i] = strconv.Itoa(line)
+		}
+		w.Header().Set("X-Malformed-Count", strconv.Itoa(malformed.Count))
+		w.Header().Set("X-Malformed-Lines", strings.Join(lines, ","))
+	}
+	out.WriteTo(w)
+}
+
+type usersPage struct {
+	Total          int               `json:"total"`
+	Offset         int               `json:"offset"`
+	Limit          int               `json:"limit"`
+	UniqueBrowsers int               `json:"unique_browsers"`
+	Malformed      *Malformed        `json:"malformed,omitempty"`
+	Users          []json.RawMessage `json:"users"`
+}
+
+// pageParams parses parameters of a page of found users
+func pageParams(r *http.Request) (o *searchOptions, offset, limit int, err error) {
+	opts, err := searchParams(r)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if o, err = newSearchOptions(append(opts, WithFormat(FormatJSON))); err != nil {
+		return nil, 0, 0, err
+	}
+	if offset, err = intParam(r, "offset", 0); err != nil {
+		return nil, 0, 0, err
+	}
+	if limit, err = intParam(r, "limit", defaultPageSize); err != nil {
+		return nil, 0, 0, err
+	}
+	if limit > maxPageSize {
+		return nil, 0, 0, fmt.Errorf("limit is at most %d", maxPageSize)
+	}
+	return o, offset, limit, nil
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	o, offset, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page := &usersPage{Offset: offset, Limit: limit, Malformed: o.newMalformed(), Users: []json.RawMessage{}}
+
+	// users of the page are written as JSON lines to buf
+	buf := &bytes.Buffer{}
+	uw := o.newResultWriter(buf)
+	var writeErr error
+	seenBrowsers := make(map[string]bool)
+
+	_, err = scanUsers(bytes.NewReader(s.dataset().users), o, seenBrowsers, page.Malformed, func(i int, user *User) {
+		if page.Total >= page.Offset && page.Total < page.Offset+page.Limit && writeErr == nil {
+			writeErr = uw.user(i, user)
+		}
+		page.Total++
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	page.UniqueBrowsers = len(seenBrowsers)
+	for _, line := range bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n")) {
+		if len(line) > 0 {
+			page.Users = append(page.Users, line)
+		}
+	}
+	writeJSON(w, page)
+}
+
+func (s *Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	opts := []ReportOption{}
+	if r.FormValue("q") != "" {
+		q, err := queryParam(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts = append(opts, WithFilter(q))
+	}
+	top, err := intParam(r, "top", 10)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts = append(opts, WithTop(top))
+
+	format := r.FormValue("format")
+	if format != "" && format != "json" && format != "text" {
+		http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+		return
+	}
+
+	report, err := Aggregate(bytes.NewReader(s.dataset().users), opts...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if format == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		report.WriteText(w)
+		return
+	}
+	writeJSON(w, report)
+}
+
+type serverStats struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Loaded   time.Time `json:"loaded"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	data := s.dataset()
+	stats := &serverStats{Path: s.path, Size: data.size, Modified: data.modTime, Loaded: data.loaded}
+
+	s.mu.Lock()
+	if s.loadErr != nil {
+		stats.Error = s.loadErr.Error()
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, stats)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	path := flag.String("file", filePath, "users file, may be compressed with gzip or zstd")
+	check := flag.Duration("check", time.Second, "how often to look whether the file has changed")
+	flag.Parse()
+
+	s, err := NewServer(*path, WithCheckInterval(*check))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving %s on %s", *path, *addr)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestServer(t *testing.T, users []byte) (*httptest.Server, string, func()) {
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "users.txt")
+	if err := ioutil.WriteFile(path, users, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(path, WithCheckInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	return ts, path, func() {
+		ts.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func get(t *testing.T, ts *httptest.Server, path string, params url.Values) (int, string) {
+	resp, err := http.Get(ts.URL + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestServerSearch(t *testing.T) {
+	ts, _, stop := newTestServer(t, readUsers(t))
+	defer stop()
+
+	expected := new(bytes.Buffer)
+	FastSearch(expected)
+	if code, body := get(t, ts, "/search", nil); code != http.StatusOK || body != expected.String() {
+		t.Errorf("results not match, status %d\nGot:\n%v\nExpected:\n%v", code, body, expected)
+	}
+
+	q := `country:"Russia" and browsers:"Android"`
+	expected.Reset()
+	if err := SearchFile(expected, filePath, WithQuery(mustParseQuery(t, q)), WithFormat(FormatCSV), WithFields(FieldName, FieldJob), WithRawEmail()); err != nil {
+		t.Fatal(err)
+	}
+	code, body := get(t, ts, "/search", url.Values{"q": {q}, "format": {"csv"}, "fields": {"name,job"}, "raw_email": {"1"}})
+	if code != http.StatusOK || body != expected.String() {
+		t.Errorf("results not match, status %d\nGot:\n%v\nExpected:\n%v", code, body, expected)
+	}
+}
+
+func TestServerPaging(t *testing.T) {
+	ts, _, stop := newTestServer(t, readUsers(t))
+	defer stop()
+
+	params := url.Values{"q": {`browsers:"Android"`}, "fields": {"name,browsers"}, "limit": {"15"}}
+	expected := new(bytes.Buffer)
+	if err := SearchFile(expected, filePath, WithQuery(mustParseQuery(t, params.Get("q"))), WithFormat(FormatJSON), WithFields(FieldName, FieldBrowsers)); err != nil {
+		t.Fatal(err)
+	}
+
+	var users []string
+	for offset := 0; ; offset += 15 {
+		params.Set("offset", strconv.Itoa(offset))
+		code, body := get(t, ts, "/users", params)
+		if code != http.StatusOK {
+			t.Fatalf("status %d: %s", code, body)
+		}
+		var page struct {
+			Total          int
+			Limit          int
+			UniqueBrowsers int `json:"unique_browsers"`
+			Users          []json.RawMessage
+		}
+		if err := json.Unmarshal([]byte(body), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Limit != 15 || page.Total != strings.Count(expected.String(), "\n") || page.UniqueBrowsers == 0 {
+			t.Fatalf("unexpected page %+v", page)
+		}
+		if len(page.Users) == 0 {
+			break
+		}
+		for _, u := range page.Users {
+			// the page is indented, results are not
+			compact := new(bytes.Buffer)
+			if err := json.Compact(compact, u); err != nil {
+				t.Fatal(err)
+			}
+			users = append(users, compact.String())
+		}
+	}
+
+	if got := strings.Join(users, "\n") + "\n"; got != expected.String() {
+		t.Errorf("pages don't make all users\nGot:\n%v\nExpected:\n%v", got, expected)
+	}
+}
+
+func TestServerUsersLastLine(t *testing.T) {
+	users := `{"browsers":["Android"],"name":"A","email":"a@a"}` + "\n" +
+		`{"browsers":["Android","MSIE"],"name":"B","email":"b@b"}`
+	ts, _, stop := newTestServer(t, []byte(users))
+	defer stop()
+
+	// the last line has no newline and is read like in /search
+	code, body := get(t, ts, "/users", nil)
+	var page struct {
+		Total int
+		Users []json.RawMessage
+	}
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatalf("status %d: %v", code, err)
+	}
+	if code != http.StatusOK || page.Total != 1 || len(page.Users) != 1 {
+		t.Errorf("expected the last user, status %d:\n%s", code, body)
+	}
+}
+
+func TestServerReport(t *testing.T) {
+	ts, _, stop := newTestServer(t, readUsers(t))
+	defer stop()
+
+	expected, err := AggregateFile(filePath, WithTop(3), WithFilter(androidAndMSIE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, body := get(t, ts, "/report", url.Values{"q": {androidAndMSIE.String()}, "top": {"3"}})
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	var report Report
+	if err := json.Unmarshal([]byte(body), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Users != expected.Users || len(report.Browsers) != 3 || report.Families[0] != expected.Families[0] {
+		t.Errorf("expected %+v, got %+v", expected, report)
+	}
+
+	if code, body := get(t, ts, "/report", url.Values{"format": {"text"}}); code != http.StatusOK || !strings.HasPrefix(body, "Users 1000\n") {
+		t.Errorf("unexpected text report, status %d:\n%s", code, body)
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	ts, _, stop := newTestServer(t, readUsers(t))
+	defer stop()
+
+	for _, req := range []struct {
+		path   string
+		params url.Values
+	}{
+		{"/search", url.Values{"q": {`browsers:`}}},
+		{"/search", url.Values{"format": {"xml"}}},
+		{"/search", url.Values{"fields": {"name,phone"}}},
+		{"/search", url.Values{"raw_email": {"maybe"}}},
+		{"/users", url.Values{"offset": {"-1"}}},
+		{"/users", url.Values{"limit": {"100000"}}},
+		{"/report", url.Values{"top": {"many"}}},
+		{"/report", url.Values{"format": {"csv"}}},
+	} {
+		if code, body := get(t, ts, req.path, req.params); code != http.StatusBadRequest {
+			t.Errorf("%s?%s: expected bad request, got %d: %s", req.path, req.params.Encode(), code, body)
+		}
+	}
+
+	resp, err := http.Post(ts.URL+"/search", "text/plain", strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %d", resp.StatusCode)
+	}
+
+	if _, err := NewServer("no-such-file.txt"); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error, got %v", err)
+	}
+}
+
+func TestServerReload(t *testing.T) {
+	users := `{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}` + "\n"
+	ts, path, stop := newTestServer(t, []byte(users))
+	defer stop()
+
+	if _, body := get(t, ts, "/search", nil); !strings.Contains(body, "[0] A <a [at] a>") || strings.Contains(body, "[1]") {
+		t.Fatalf("unexpected result:\n%s", body)
+	}
+
+	users += `{"browsers":["Android 2","MSIE 6"],"name":"B","email":"b@b"}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(users), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(t, ts, "/search", nil); !strings.Contains(body, "[1] B <b [at] b>") {
+		t.Errorf("changed file is not loaded:\n%s", body)
+	}
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, body := get(t, ts, "/search", nil); !strings.Contains(body, "[1] B <b [at] b>") {
+		t.Errorf("users should be kept when the file is gone:\n%s", body)
+	}
+	if _, body := get(t, ts, "/stats", nil); !strings.Contains(body, `"error"`) {
+		t.Errorf("stats should show the error:\n%s", body)
+	}
+}
+
+func TestServerReloadInBackground(t *testing.T) {
+	users := `{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}` + "\n"
+	dir, err := ioutil.TempDir("", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.txt")
+	if err := ioutil.WriteFile(path, []byte(users), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewServer(path, WithCheckInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loads int32
+	entered, release := make(chan struct{}), make(chan struct{})
+	s.load = func(path string) (*dataset, error) {
+		atomic.AddInt32(&loads, 1)
+		entered <- struct{}{}
+		<-release
+		return loadDataset(path)
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	users += `{"browsers":["Android 2","MSIE 6"],"name":"B","email":"b@b"}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(users), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded := make(chan string)
+	go func() {
+		_, body := get(t, ts, "/search", nil)
+		reloaded <- body
+	}()
+	<-entered
+
+	// requests during the reload get the old users at once and don't load the file again
+	for i := 0; i < 3; i++ {
+		done := make(chan string)
+		go func() {
+			_, body := get(t, ts, "/search", nil)
+			done <- body
+		}()
+		select {
+		case body := <-done:
+			if strings.Contains(body, "[1]") {
+				t.Errorf("the file is not loaded yet:\n%s", body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request is blocked by the reload")
+		}
+	}
+
+	close(release)
+	if body := <-reloaded; !strings.Contains(body, "[1] B <b [at] b>") {
+		t.Errorf("changed file is not loaded:\n%s", body)
+	}
+	if n := atomic.LoadInt32(&loads); n != 1 {
+		t.Errorf("expected the file to be loaded once, got %d", n)
+	}
+}
+
+func TestServerLenient(t *testing.T) {
+	users := `{"browsers":["Android","MSIE"],"name":"A","email":"a@a"}` + "\n" +
+		"not json\n" +
+		`{"browsers":["Android 2","MSIE 6"],"name":"B","email":"b@b"}`
+	ts, _, stop := newTestServer(t, []byte(users))
+	defer stop()
+
+	if code, body := get(t, ts, "/search", nil); code != http.StatusInternalServerError || !strings.Contains(body, "line 2") {
+		t.Errorf("expected an error in line 2, got %d: %s", code, body)
+	}
+	if _, body := get(t, ts, "/search", url.Values{"lenient": {"true"}}); !strings.HasSuffix(body, "[2] B <b [at] b>\n\nTotal unique browsers 4\nMalformed lines 1: 2\n") {
+		t.Errorf("unexpected result:\n%s", body)
+	}
+
+	code, body := get(t, ts, "/users", url.Values{"lenient": {"1"}})
+	if code != http.StatusOK {
+		t.Fatalf("status %d: %s", code, body)
+	}
+	var page usersPage
+	if err := json.Unmarshal([]byte(body), &page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 2 || page.Malformed == nil || page.Malformed.Count != 1 || page.Malformed.Lines[0] != 2 {
+		t.Errorf("unexpected page %+v", page)
+	}
+
+	// JSON has only found users, malformed lines are in headers
+	resp, err := http.Get(ts.URL + "/search?" + url.Values{"lenient": {"1"}, "format": {"json"}, "fields": {"name"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"index":0,"name":"A"}` + "\n" + `{"index":2,"name":"B"}` + "\n"
+	if resp.StatusCode != http.StatusOK || string(data) != expected {
+		t.Errorf("expected\n%s\ngot %d:\n%s", expected, resp.StatusCode, data)
+	}
+	if count, lines := resp.Header.Get("X-Malformed-Count"), resp.Header.Get("X-Malformed-Lines"); count != "1" || lines != "2" {
+		t.Errorf("expected 1 malformed line 2 in headers, got %q and %q", count, lines)
+	}
+}